@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 const (
 	LogQueueSize     = 10000
 	ConsumerNumber   = 1
@@ -9,4 +11,86 @@ const (
 	LogFuncMax       = "max"
 	LogFuncMin       = "min"
 	LogFuncAvg       = "avg"
+	// 将正则数字observe到prometheus的Histogram/Summary中
+	LogFuncHistogram = "histogram"
+	LogFuncSummary   = "summary"
+	// 原生直方图默认的桶上限比例、桶数量上限以及桶数量超限时的最短重置间隔
+	NativeHistogramBucketFactor     = 1.1
+	NativeHistogramMaxBuckets       = 160
+	NativeHistogramMinResetDuration = time.Hour
+
+	// SeriesExpireInterval 清理过期series的间隔
+	SeriesExpireInterval = 10 * time.Second
+	// max/min/avg的统计窗口类型
+	WindowTumbling = "tumbling"
+	WindowSliding  = "sliding"
+	// WindowSlots sliding窗口切分的slot数量
+	WindowSlots = 6
+
+	// ConfigCheckInterval 配置文件变化检测间隔
+	ConfigCheckInterval = 5 * time.Second
+	// FileScanInterval file_path(glob/目录)重新扫描文件的间隔
+	FileScanInterval = 10 * time.Second
+	// CheckpointFile 读取位置记录的默认文件
+	CheckpointFile = "log2metrics.checkpoint"
+	// CheckpointInterval reader更新读取位置以及默认落盘的间隔
+	CheckpointInterval = 5 * time.Second
+	// CheckpointExpire 超过该时间未更新的读取位置记录会被清理
+	CheckpointExpire = 7 * 24 * time.Hour
+	// RotatedInodes 每个reader记住的滚动前inode数量, 目录和glob不会再以滚动后的文件名重复读取这些文件
+	RotatedInodes = 16
+
+	// Stream满时的处理策略
+	OverflowBlock      = "block"
+	OverflowDropNewest = "drop_newest"
+	OverflowDropOldest = "drop_oldest"
+	OverflowSpill      = "spill"
+	// SpillDir 磁盘队列的默认目录
+	SpillDir = "spill"
+	// SpillMaxBytes 单个磁盘队列的默认上限
+	SpillMaxBytes = 64 << 20
+
+	// BatchFlushInterval 消费者推送本地预聚合结果的间隔
+	BatchFlushInterval = time.Second
+	// BatchMaxLines 消费者本地预聚合的行数达到该值时立即推送
+	BatchMaxLines = 1000
+
+	// AutoscaleInterval 检测Stream积压调整消费者数量的默认间隔
+	AutoscaleInterval = 5 * time.Second
+	// Stream积压占容量的比例超过AutoscaleScaleUp时增加消费者, 低于AutoscaleScaleDown时减少消费者
+	AutoscaleScaleUp   = 0.5
+	AutoscaleScaleDown = 0.1
+	// AutoscaleScaleDownChecks 连续多少次检测积压都低于AutoscaleScaleDown时才减少消费者
+	AutoscaleScaleDownChecks = 3
+
+	// MultilineMaxLines 多行事件默认的最大行数
+	MultilineMaxLines = 500
+	// MultilineFlushTimeout 多行事件默认的推送超时
+	MultilineFlushTimeout = time.Second
+
+	// series数量超过max_series时新标签组合的处理方式
+	SeriesOverflowFold = "fold"
+	SeriesOverflowDrop = "drop"
+
+	// 日志解析方式
+	ParserRegex  = "regex"
+	ParserJSON   = "json"
+	ParserLogfmt = "logfmt"
+	ParserFormat = "format"
+	// 预置的日志格式
+	FormatNginxCombined = "nginx_combined"
+	FormatApacheCommon  = "apache_common"
+	FormatSyslogRFC3164 = "syslog_rfc3164"
+	FormatSyslogRFC5424 = "syslog_rfc5424"
+
+	// ValueGroup pattern中作为数值的命名分组的默认名称
+	ValueGroup = "value"
+
+	// SeriesOverflowValue fold时超限的标签组合统一合并为该标签值
+	SeriesOverflowValue = "__overflow__"
+	// SeriesShards PointCounterManager中series的分片数量
+	SeriesShards = 64
 )
+
+// SummaryQuantiles summary未配置分位数时的默认值
+var SummaryQuantiles = []float64{0.5, 0.9, 0.99}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"log2metrics/src/common"
 	"log2metrics/src/common/nginx_log_generator"
+	"log2metrics/src/modules/agent/checkpoint"
 	"log2metrics/src/modules/agent/config"
 	"log2metrics/src/modules/agent/consumer"
 	"log2metrics/src/modules/agent/counter"
@@ -14,6 +15,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -21,10 +23,10 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/common/promlog"
 	promlogflag "github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
-	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var (
@@ -53,30 +55,38 @@ func main() {
 	}
 	log.Println("Loading config successfully")
 
-	// 拿出metricsMap注册
-	metricsMap := metrics.CreateMetrics(agentConfig.LogStrategies)
-	for _, m := range metricsMap {
-		prometheus.MustRegister(m)
-	}
-
 	// 统计指标的同步Queue
-	cq := make(chan *consumer.AnalysisPoint, common.CounterQueueSize)
-	// 统计指标管理器
-	PointCounterManager := counter.NewPointCounterManager(cq, metricsMap)
+	cq := make(chan []*consumer.AnalysisPoint, common.CounterQueueSize)
+	// 统计指标管理器, 同时在抓取时为cnt/sum/max/min/avg指标提供当前值
+	PointCounterManager := counter.NewPointCounterManager(cq, nil)
+	PointCounterManager.SetMaxSeries(agentConfig.MaxSeries)
+
+	// 拿出metricsMap注册, 热加载时通过metricsRegistry增量注册/注销
+	metricsRegistry := metrics.NewMetricsRegistry(prometheus.DefaultRegisterer, PointCounterManager)
+	metricsMap := metricsRegistry.Sync(agentConfig.LogStrategies)
+	PointCounterManager.SetMetricsMap(metricsMap)
+
+	// 注册agent自身的运行指标
+	if err := metrics.RegisterSelfMetrics(prometheus.DefaultRegisterer, func() float64 { return float64(len(cq)) }); err != nil {
+		log.Printf("%+v\n", err)
+		return
+	}
+	// 读取位置存储, 未开启时为nil
+	var checkpointStore *checkpoint.Store
+	if agentConfig.Checkpoint != nil && agentConfig.Checkpoint.Enable {
+		checkpointStore, err = checkpoint.NewStore(agentConfig.Checkpoint.Path, common.CheckpointExpire)
+		if err != nil {
+			log.Printf("%+v\n", err)
+			return
+		}
+	}
 	// 日志job管理器
-	logJobManager := logjob.NewLogJobManager(cq)
+	logJobManager := logjob.NewLogJobManager(cq, checkpointStore)
 	// 把配置文件的logJob传入
 	logJobSyncChan := make(chan []*logjob.LogJob, 1)
 
 	// 从配置里面获取到jobs列表后通过channel发送给logJobManager
-	jobs := make([]*logjob.LogJob, 0)
-	for _, i := range agentConfig.LogStrategies {
-		i := i
-		job := &logjob.LogJob{Strategy: i}
-		// 叠加job到jobs中
-		jobs = append(jobs, job)
-	}
-	logJobSyncChan <- jobs
+	logJobSyncChan <- buildLogJobs(agentConfig.LogStrategies, metricsMap)
 
 	var g run.Group
 	ctx, cancel := context.WithCancel(context.Background())
@@ -130,11 +140,24 @@ func main() {
 			})
 		}
 
+		// 读取位置定期落盘
+		if checkpointStore != nil {
+			g.Add(func() error {
+				err := checkpointStore.FlushManager(ctx, agentConfig.Checkpoint.Interval)
+				if err != nil {
+					log.Printf("%+v", err)
+				}
+				return nil
+			}, func(err error) {
+				cancel()
+			})
+		}
+
 		// PointCounter实体管理器，从counterQueue接收AnalysisPoint并使用PointCounter进行统计处理
 		{
 			g.Add(func() error {
 				// 传入ctx控制PointCounterManager生命周期,调用UpdateManager方法,消费CounterQueue并且构造PointCounter实体进行对应统计function的统计
-				err := PointCounterManager.UpdateManager(ctx)
+				err := PointCounterManager.UpdateManager(ctx, agentConfig.UpdateWorkers)
 				if err != nil {
 					log.Printf("%+v", err)
 				}
@@ -143,11 +166,11 @@ func main() {
 				cancel()
 			})
 		}
-		// 统计任务实体转化为prometheus metrics的任务, 通过metrics endpoint进行指标展示
+		// 清理过期series的任务, 指标的值在metrics endpoint被抓取时直接从PointCounter计算
 		{
 			g.Add(func() error {
 				// 传入控制goroutine生命周期的ctx
-				err := PointCounterManager.SetMetricsManager(ctx)
+				err := PointCounterManager.ExpireManager(ctx, common.SeriesExpireInterval)
 				if err != nil {
 					log.Printf("%+v", err)
 				}
@@ -156,6 +179,36 @@ func main() {
 				cancel()
 			})
 		}
+		// 配置热加载: 接收到SIGHUP信号或检测到配置文件变化后重新加载log_strategies
+		{
+			hupChan := make(chan os.Signal, 1)
+			signal.Notify(hupChan, syscall.SIGHUP)
+			g.Add(func() error {
+				ticker := time.NewTicker(common.ConfigCheckInterval)
+				defer ticker.Stop()
+				lastStat := statConfigFile(*configFile)
+				for {
+					select {
+					case <-ctx.Done():
+						log.Println("config reloader receive quit signal.. would be stopped soon")
+						return nil
+					case <-hupChan:
+						log.Println("notify a SIGHUP syscall.. reloading config")
+					case <-ticker.C:
+						// 通过修改时间和大小判断配置文件是否发生变化
+						if stat := statConfigFile(*configFile); stat == lastStat {
+							continue
+						}
+						log.Println("config file changed.. reloading config")
+					}
+					lastStat = statConfigFile(*configFile)
+					reloadConfig(ctx, *configFile, metricsRegistry, PointCounterManager, logJobSyncChan)
+				}
+			}, func(err error) {
+				signal.Stop(hupChan)
+				cancel()
+			})
+		}
 		// logJob metrics 结果的httpserver
 		{
 			// 启动httpserver并注入prometheus的http handler进行内存中metrics的展示
@@ -179,6 +232,9 @@ func main() {
 					cancel()
 				})
 		}
+	} else {
+		// 未开启日志采集时没有需要重新加载的策略, 忽略SIGHUP, 避免默认行为终止进程
+		signal.Ignore(syscall.SIGHUP)
 	}
 
 	// nginx日志生成器
@@ -195,3 +251,53 @@ func main() {
 
 	g.Run()
 }
+
+// 配置文件状态, 用于判断配置文件是否被修改
+type configFileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+func statConfigFile(filename string) configFileStat {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return configFileStat{}
+	}
+	return configFileStat{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// 根据日志策略构造jobs列表, 每个strategy对应一个job
+// 与同名metric冲突或注册失败的策略没有对应的指标, 不构造job
+func buildLogJobs(ss []*config.LogStrategy, metricsMap map[string]*metrics.StrategyMetric) []*logjob.LogJob {
+	jobs := make([]*logjob.LogJob, 0)
+	for _, i := range ss {
+		i := i
+		if m, loaded := metricsMap[i.MetricName]; !loaded || !m.Owns(i.Fingerprint()) {
+			continue
+		}
+		job := &logjob.LogJob{Strategy: i}
+		// 叠加job到jobs中
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// 重新加载配置文件, 同步metrics的注册并将新的jobs列表发送给logJobManager进行增量更新
+func reloadConfig(ctx context.Context, filename string, registry *metrics.MetricsRegistry, pcm *counter.PointCounterManager, syncChan chan []*logjob.LogJob) {
+	cfg, err := config.LoadFile(filename)
+	if err != nil {
+		// 加载失败时沿用之前的配置继续运行
+		log.Printf("%+v\n", errors.Wrap(err, "reloadConfig: reload config failed, keep running with previous config"))
+		return
+	}
+	// 先同步metrics, 新增的策略产生的数据才能找到对应的GaugeVec
+	metricsMap := registry.Sync(cfg.LogStrategies)
+	pcm.SetMetricsMap(metricsMap)
+	pcm.SetMaxSeries(cfg.MaxSeries)
+
+	select {
+	case syncChan <- buildLogJobs(cfg.LogStrategies, metricsMap):
+		log.Printf("reloadConfig: reload config successfully [strategies:%d]", len(cfg.LogStrategies))
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,190 @@
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Entry 单个文件的读取位置, 以 path+inode+device 唯一标识
+type Entry struct {
+	Path   string `json:"path"`
+	Dev    uint64 `json:"dev"`
+	Ino    uint64 `json:"ino"`
+	Offset int64  `json:"offset"`
+	Ts     int64  `json:"ts"` // 最后一次更新时间, 用于清理过期记录
+}
+
+// Store 读取位置的本地存储, 内存中更新, 定期以及退出时落盘
+// 方法对nil接收者安全, 未开启checkpoint时直接传入nil即可
+type Store struct {
+	sync.Mutex
+	path    string
+	expire  time.Duration
+	entries map[string]*Entry
+	dirty   bool
+}
+
+// NewStore 根据文件路径创建Store, 文件存在时加载已有的记录
+func NewStore(path string, expire time.Duration) (*Store, error) {
+	s := &Store{
+		path:    path,
+		expire:  expire,
+		entries: make(map[string]*Entry),
+	}
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, errors.Wrapf(err, "checkpoint.NewStore: read checkpoint file failed: %s", path)
+	}
+	var entries []*Entry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		return nil, errors.Wrapf(err, "checkpoint.NewStore: unmarshal checkpoint file failed: %s", path)
+	}
+	for _, e := range entries {
+		s.entries[key(e.Path, e.Dev, e.Ino)] = e
+	}
+	log.Printf("[checkpoint.NewStore: load checkpoints successfully][path:%s][num:%d]", path, len(entries))
+	return s, nil
+}
+
+func key(path string, dev, ino uint64) string {
+	return fmt.Sprintf("%s|%d|%d", path, dev, ino)
+}
+
+// Latest 获取路径最近一次记录的读取位置(不区分inode), 用于判断文件是否在agent停止期间发生了滚动
+func (s *Store) Latest(path string) (*Entry, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	var latest *Entry
+	for _, e := range s.entries {
+		if e.Path == path && (latest == nil || e.Ts > latest.Ts) {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return nil, false
+	}
+	res := *latest
+	return &res, true
+}
+
+// Owner 获取inode最近一次记录的读取位置, 用于判断文件是否已经以其它路径读取过(如滚动后被重命名)
+func (s *Store) Owner(dev, ino uint64) (*Entry, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	var latest *Entry
+	for _, e := range s.entries {
+		if e.Dev == dev && e.Ino == ino && (latest == nil || e.Ts > latest.Ts) {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return nil, false
+	}
+	res := *latest
+	return &res, true
+}
+
+// Set 更新文件的读取位置
+func (s *Store) Set(path string, dev, ino uint64, offset int64) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.entries[key(path, dev, ino)] = &Entry{
+		Path:   path,
+		Dev:    dev,
+		Ino:    ino,
+		Offset: offset,
+		Ts:     time.Now().Unix(),
+	}
+	s.dirty = true
+}
+
+// Delete 删除文件的读取位置, 文件滚动后旧inode的记录不再需要
+func (s *Store) Delete(path string, dev, ino uint64) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, loaded := s.entries[key(path, dev, ino)]; loaded {
+		delete(s.entries, key(path, dev, ino))
+		s.dirty = true
+	}
+}
+
+// Flush 清理过期记录后写入本地文件, 先写临时文件再rename保证文件完整
+func (s *Store) Flush() error {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	expireTs := time.Now().Add(-s.expire).Unix()
+	entries := make([]*Entry, 0, len(s.entries))
+	for k, e := range s.entries {
+		if s.expire > 0 && e.Ts < expireTs {
+			delete(s.entries, k)
+			s.dirty = true
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if !s.dirty {
+		return nil
+	}
+
+	bs, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "Store.Flush: marshal checkpoints failed")
+	}
+	tmp := s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.Wrapf(err, "Store.Flush: create checkpoint dir failed: %s", s.path)
+	}
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return errors.Wrapf(err, "Store.Flush: write checkpoint file failed: %s", tmp)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrapf(err, "Store.Flush: rename checkpoint file failed: %s", s.path)
+	}
+	s.dirty = false
+	return nil
+}
+
+// FlushManager 定期将读取位置落盘, 退出时的最终落盘由LogJobManager在停止全部reader后完成
+func (s *Store) FlushManager(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("checkpoint.FlushManager.receive_quit_signal_and_quit")
+			return nil
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("%+v", err)
+			}
+		}
+	}
+}
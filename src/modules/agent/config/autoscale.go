@@ -0,0 +1,55 @@
+package config
+
+import (
+	"log2metrics/src/common"
+	"runtime"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Autoscale 根据Stream积压自动调整消费者数量, consumers为消费者数量的下限
+type Autoscale struct {
+	MaxConsumers int           `json:"max_consumers" yaml:"max_consumers"` // 消费者数量上限, 默认为CPU核数与consumers中较大的值
+	Interval     time.Duration `json:"interval" yaml:"interval"`           // 检测Stream积压的间隔
+	// Stream积压占容量的比例超过scale_up时增加一个消费者, 低于scale_down时减少一个消费者
+	ScaleUp   float64 `json:"scale_up" yaml:"scale_up"`
+	ScaleDown float64 `json:"scale_down" yaml:"scale_down"`
+}
+
+// 校验消费者数量及autoscale配置并设置默认值
+func setConsumers(st *LogStrategy) error {
+	if st.Consumers < 0 {
+		return errors.Errorf("config.setConsumers: consumers must not be negative: %s", st.MetricName)
+	}
+	if st.Consumers == 0 {
+		st.Consumers = common.ConsumerNumber
+	}
+	as := st.Autoscale
+	if as == nil {
+		return nil
+	}
+	if as.MaxConsumers <= 0 {
+		// consumers大于CPU核数时以consumers为上限, 不再扩容
+		as.MaxConsumers = runtime.NumCPU()
+		if as.MaxConsumers < st.Consumers {
+			as.MaxConsumers = st.Consumers
+		}
+	}
+	if as.MaxConsumers < st.Consumers {
+		return errors.Errorf("config.setConsumers: max_consumers %d is less than consumers %d: %s", as.MaxConsumers, st.Consumers, st.MetricName)
+	}
+	if as.Interval <= 0 {
+		as.Interval = common.AutoscaleInterval
+	}
+	if as.ScaleUp == 0 {
+		as.ScaleUp = common.AutoscaleScaleUp
+	}
+	if as.ScaleDown == 0 {
+		as.ScaleDown = common.AutoscaleScaleDown
+	}
+	if as.ScaleUp > 1 || as.ScaleDown < 0 || as.ScaleDown >= as.ScaleUp {
+		return errors.Errorf("config.setConsumers: require 0 <= scale_down < scale_up <= 1: %s", st.MetricName)
+	}
+	return nil
+}
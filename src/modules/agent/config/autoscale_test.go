@@ -0,0 +1,34 @@
+package config
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestSetConsumersDefaultMaxConsumers(t *testing.T) {
+	cases := []struct {
+		consumers int
+		want      int
+	}{
+		{0, runtime.NumCPU()},
+		{1, runtime.NumCPU()},
+		// consumers超过CPU核数时不能因为默认的上限而被拒绝
+		{runtime.NumCPU() + 4, runtime.NumCPU() + 4},
+	}
+	for _, c := range cases {
+		st := &LogStrategy{MetricName: "m", Consumers: c.consumers, Autoscale: &Autoscale{}}
+		if err := setConsumers(st); err != nil {
+			t.Fatalf("consumers %d: %v", c.consumers, err)
+		}
+		if st.Autoscale.MaxConsumers != c.want {
+			t.Errorf("consumers %d: max_consumers %d, want %d", c.consumers, st.Autoscale.MaxConsumers, c.want)
+		}
+	}
+}
+
+func TestSetConsumersRejectsMaxBelowConsumers(t *testing.T) {
+	st := &LogStrategy{MetricName: "m", Consumers: 4, Autoscale: &Autoscale{MaxConsumers: 2}}
+	if err := setConsumers(st); err == nil {
+		t.Errorf("max_consumers below consumers accepted")
+	}
+}
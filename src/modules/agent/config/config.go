@@ -1,9 +1,16 @@
 package config
 
 import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"io/ioutil"
 	"log"
+	"log2metrics/src/common"
 	"regexp"
+	"runtime"
+	"sort"
+	"time"
 
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
@@ -15,6 +22,20 @@ type Config struct {
 	HttpAddr      string         `yaml:"http_addr"`
 	LocalConfig   *Local         `yaml:"local_config"`
 	LogCollecting *LogCollecting `yaml:"log_collecting"`
+	Checkpoint    *Checkpoint    `yaml:"checkpoint"`
+	// 全部策略的series总数上限, 为0时不限制
+	MaxSeries int `yaml:"max_series"`
+	// 并行消费CounterQueue的worker数量, 默认为CPU核数, 修改后需要重启
+	UpdateWorkers int `yaml:"update_workers"`
+	// 用户自定义的grok pattern文件, 与内置的pattern库一起用于展开pattern中的%{NAME:field}
+	GrokPatterns []string `yaml:"grok_patterns"`
+}
+
+// Checkpoint 读取位置记录配置, 重启后从记录的位置继续读取
+type Checkpoint struct {
+	Enable   bool          `yaml:"enable"`
+	Path     string        `yaml:"path"`     // 记录文件路径
+	Interval time.Duration `yaml:"interval"` // 落盘间隔
 }
 
 type LogCollecting struct {
@@ -28,17 +49,89 @@ type Local struct {
 
 // LogStrategy 定义log配置结构体
 type LogStrategy struct {
-	ID         int64             `json:"id" yaml:"-"`
-	MetricName string            `json:"metric_name" yaml:"metric_name"`
-	MetricHelp string            `json:"metric_help" yaml:"metric_help"`
-	FilePath   string            `json:"file_path" yaml:"file_path"`
-	Pattern    string            `json:"pattern" yaml:"pattern"`
+	ID         int64  `json:"id" yaml:"-"`
+	MetricName string `json:"metric_name" yaml:"metric_name"`
+	MetricHelp string `json:"metric_help" yaml:"metric_help"`
+	FilePath   string `json:"file_path" yaml:"file_path"`
+	Pattern    string `json:"pattern" yaml:"pattern"`
+	ValueGroup string `json:"value_group" yaml:"value_group"` // pattern中作为数值的命名分组, 默认为value, 其余命名分组作为标签
+	// 日志解析方式: regex(默认)/json/logfmt, 为json时tags的值为json路径, 为logfmt时为key
+	Parser     string            `json:"parser" yaml:"parser"`
+	ValueField string            `json:"value_field" yaml:"value_field"` // 结构化日志中作为数值的字段, 为空时没有数值
+	Filters    []string          `json:"filters" yaml:"filters"`         // 结构化日志的字段过滤条件, 全部满足才处理
+	Format     string            `json:"format" yaml:"format"`           // 预置的日志格式, 设置后tags的值为字段名
 	Func       string            `json:"func" yaml:"func"`
 	Tags       map[string]string `json:"tags" yaml:"tags"`
 	Creator    string            `json:"creator" yaml:"creator"`
+	FileLabel  string            `json:"file_label" yaml:"file_label"` // file_path为glob或目录时, 以该标签名暴露匹配到的文件路径
+	// file_path为glob或目录时默认跳过滚动或压缩后的文件(如 app.log.1、app.log-20240101、*.gz), 为true时同样采集
+	IncludeRotated bool `json:"include_rotated" yaml:"include_rotated"`
+	// 在解析之前过滤日志: 必须包含contains中的全部字面量, 且不匹配exclude中的任一正则
+	Contains []string `json:"contains" yaml:"contains"`
+	Exclude  []string `json:"exclude" yaml:"exclude"`
+	// 起始读取位置: end/beginning/offset:<n>/time:<t>, 存在checkpoint记录时以记录为准
+	ReadFrom    string `json:"read_from" yaml:"read_from"`
+	TimePattern string `json:"time_pattern" yaml:"time_pattern"` // 提取日志时间的正则, 取第一个分组
+	TimeLayout  string `json:"time_layout" yaml:"time_layout"`   // 日志时间的格式, 如 02/Jan/2006:15:04:05 -0700
+	// Stream满时的处理策略
+	Overflow *Overflow `json:"overflow" yaml:"overflow"`
+	// 多行日志组装为一个事件后再推送到Stream
+	Multiline *Multiline `json:"multiline" yaml:"multiline"`
+	// 每个文件的消费者数量, 默认为1; 配置autoscale时根据Stream积压在consumers和max_consumers之间调整
+	Consumers int        `json:"consumers" yaml:"consumers"`
+	Autoscale *Autoscale `json:"autoscale" yaml:"autoscale"`
+	// func为histogram/summary时的配置
+	Histogram *Histogram `json:"histogram" yaml:"histogram"`
+	Summary   *Summary   `json:"summary" yaml:"summary"`
+	// max/min/avg的统计窗口, 为空时统计进程启动以来的全部数据
+	Window     time.Duration `json:"window" yaml:"window"`
+	WindowType string        `json:"window_type" yaml:"window_type"` // tumbling(默认, 导出上一个完整窗口)/sliding(最近window时间内)
+	// series超过该时间没有新日志时删除, 为空时永不过期
+	SeriesTTL time.Duration `json:"series_ttl" yaml:"series_ttl"`
+	// series数量上限, 超过后新的标签组合按series_overflow处理: fold(默认)/drop
+	MaxSeries      int    `json:"max_series" yaml:"max_series"`
+	SeriesOverflow string `json:"series_overflow" yaml:"series_overflow"`
+	// pattern为grok时展开后的正则, 参与指纹计算, grok pattern文件修改后对应的job会重启
+	ExpandedPattern string `json:"expanded_pattern,omitempty" yaml:"-"`
 	// 通过解析后获取的正则表达式, 上面的是前端配置
-	PatternReg *regexp.Regexp            `json:"-" yaml:"-"` // core Reg
-	TagRegs    map[string]*regexp.Regexp `json:"-" yaml:"-"` // tags Reg
+	PatternReg   *regexp.Regexp            `json:"-" yaml:"-"` // core Reg
+	TagRegs      map[string]*regexp.Regexp `json:"-" yaml:"-"` // tags Reg
+	GroupLabels  map[string]int            `json:"-" yaml:"-"` // 命名分组标签名对应的分组下标
+	ValueIndex   int                       `json:"-" yaml:"-"` // 数值对应的分组下标, 为0时没有数值
+	ValuePath    *JSONPath                 `json:"-" yaml:"-"` // parser为json时数值的路径
+	TagPaths     map[string]*JSONPath      `json:"-" yaml:"-"` // parser为json时tags的路径
+	FilterRules  []*Filter                 `json:"-" yaml:"-"` // 解析后的过滤条件
+	ExcludeRegs  []*regexp.Regexp          `json:"-" yaml:"-"` // exclude Reg
+	Literals     []string                  `json:"-" yaml:"-"` // 主正则匹配时必然出现的字面量
+	ReadPosition *ReadPosition             `json:"-" yaml:"-"` // 解析后的起始读取位置
+}
+
+// LabelNames 策略生成的metric的全部标签名(排序后)
+func (s *LogStrategy) LabelNames() []string {
+	labels := make([]string, 0, len(s.Tags)+len(s.GroupLabels)+1)
+	for k := range s.Tags {
+		labels = append(labels, k)
+	}
+	for k := range s.GroupLabels {
+		labels = append(labels, k)
+	}
+	if s.FileLabel != "" {
+		labels = append(labels, s.FileLabel)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Fingerprint 根据策略的全部配置内容生成指纹, 用于检测策略是否被修改
+func (s *LogStrategy) Fingerprint() string {
+	// 编译后的正则不参与序列化, json会对map的key进行排序, 保证相同内容生成相同指纹
+	bs, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "LogStrategy.Fingerprint: marshal strategy failed: %s", s.MetricName))
+		return ""
+	}
+	sum := md5.Sum(bs)
+	return hex.EncodeToString(sum[:])
 }
 
 // Load 根据LoadFile读取配置文件后的字符串解析yaml为配置结构体
@@ -65,39 +158,131 @@ func LoadFile(filename string) (*Config, error) {
 		return nil, errors.Wrap(err, "LoadFile: Error while reader reading bytes")
 	}
 
+	if cfg.UpdateWorkers <= 0 {
+		cfg.UpdateWorkers = runtime.NumCPU()
+	}
+
+	// checkpoint默认值
+	if cfg.Checkpoint != nil {
+		if cfg.Checkpoint.Path == "" {
+			cfg.Checkpoint.Path = common.CheckpointFile
+		}
+		if cfg.Checkpoint.Interval <= 0 {
+			cfg.Checkpoint.Interval = common.CheckpointInterval
+		}
+	}
+
 	// 加载日志策略配置
-	cfg.LogStrategies = setLogRegs(cfg)
+	cfg.LogStrategies = ParseStrategies(cfg.LogStrategies, cfg.GrokPatterns)
 
 	return cfg, nil
 }
 
-// 解析用户配置的日志策略正则
-func setLogRegs(cfg *Config) []*LogStrategy {
+// 根据主正则的命名分组确定标签及数值对应的分组
+// 没有命名分组时沿用第一个分组作为数值; 有命名分组时只有value_group对应的分组作为数值, 其余作为标签
+func setPatternGroups(st *LogStrategy) error {
+	if st.ValueGroup == "" {
+		st.ValueGroup = common.ValueGroup
+	}
+	st.GroupLabels = make(map[string]int)
+	st.ValueIndex = 1
+	if st.PatternReg == nil {
+		return nil
+	}
+	named := false
+	for i, name := range st.PatternReg.SubexpNames() {
+		if name == "" {
+			continue
+		}
+		if !named {
+			named = true
+			st.ValueIndex = 0
+		}
+		if name == st.ValueGroup {
+			st.ValueIndex = i
+			continue
+		}
+		if _, ok := st.Tags[name]; ok || name == st.FileLabel {
+			return errors.Errorf("config.setPatternGroups: named group %s conflicts with tags or file_label of metric %s", name, st.MetricName)
+		}
+		st.GroupLabels[name] = i
+	}
+	return nil
+}
+
+// ParseStrategies 校验日志策略、设置默认值并编译正则, 返回校验通过的策略, 未通过的策略输出日志后跳过
+// grokPatterns为用户自定义的grok pattern文件
+func ParseStrategies(ss []*LogStrategy, grokPatterns []string) []*LogStrategy {
 	var res []*LogStrategy
 
+	// 加载grok pattern库, 用户pattern文件加载失败时仍然可以使用内置的pattern
+	grok, err := newGrokLibrary(grokPatterns)
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+
 	// 处理主正则
-	for _, st := range cfg.LogStrategies {
+	for _, st := range ss {
 		st := st
-		st.TagRegs = make(map[string]*regexp.Regexp)
-		if len(st.Pattern) != 0 {
-			// 编译正则表达式
-			reg, err := regexp.Compile(st.Pattern)
-			if err != nil {
-				log.Printf("%+v", errors.Wrapf(err, "config.setLogRegs: compile pattern regexp failed: %s\n", st.Pattern))
-				continue
-			}
-			st.PatternReg = reg
-		}
-		// 处理tags正则
-		for tagK, tagV := range st.Tags {
-			reg, err := regexp.Compile(tagV)
-			if err != nil {
-				log.Printf("%+v", errors.Wrapf(err, "config.setLogRegs: compile tags pattern regexp failed: %s\n", tagV))
-				continue
-			}
-			st.TagRegs[tagK] = reg
+		// 校验计算方式, 默认为cnt
+		switch st.Func {
+		case "":
+			st.Func = common.LogFuncCnt
+		case common.LogFuncCnt, common.LogFuncSum, common.LogFuncMax, common.LogFuncMin, common.LogFuncAvg,
+			common.LogFuncHistogram, common.LogFuncSummary:
+		default:
+			log.Printf("%+v", errors.Errorf("config.ParseStrategies: unknown func %s of metric %s", st.Func, st.MetricName))
+			continue
+		}
+		// 处理histogram/summary配置
+		if err := setObserve(st); err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		// 处理统计窗口配置
+		if err := setWindow(st); err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		// 处理series数量限制
+		if err := setSeriesLimit(st); err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		// 根据解析方式编译正则或字段路径
+		if err := setParser(st, grok); err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		// 处理解析前的过滤条件
+		if err := setPrefilter(st); err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		// 处理起始读取位置
+		pos, err := parseReadFrom(st)
+		if err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		st.ReadPosition = pos
+		// 处理overflow策略
+		if err := setOverflow(st); err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		// 处理多行日志配置
+		if err := setMultiline(st); err != nil {
+			log.Printf("%+v", err)
+			continue
+		}
+		// 处理消费者数量配置
+		if err := setConsumers(st); err != nil {
+			log.Printf("%+v", err)
+			continue
 		}
 		res = append(res, st)
 	}
+	warnSharedReadFrom(res)
 	return res
 }
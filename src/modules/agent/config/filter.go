@@ -0,0 +1,83 @@
+package config
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 过滤表达式: <字段> <操作符> <值>, 值可以使用双引号
+var filterReg = regexp.MustCompile(`^\s*(\S+?)\s*(==|!=|>=|<=|=~|!~|>|<)\s*(.*?)\s*$`)
+
+// Filter 结构化日志的字段过滤条件, 不满足的日志行直接丢弃
+type Filter struct {
+	Expr  string
+	Field string    // 字段名, parser为json时为json路径
+	Path  *JSONPath // parser为json时解析后的字段路径
+	Op    string
+	Value string
+	num   float64
+	isNum bool
+	reg   *regexp.Regexp
+}
+
+// ParseFilter 解析过滤表达式, 如 $.level == "error", status >= 500, path =~ "^/api"
+func ParseFilter(expr string) (*Filter, error) {
+	m := filterReg.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, errors.Errorf("config.ParseFilter: invalid filter expression %s", expr)
+	}
+	f := &Filter{Expr: expr, Field: m[1], Op: m[2], Value: m[3]}
+	if strings.HasPrefix(f.Value, `"`) {
+		v, err := strconv.Unquote(f.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "config.ParseFilter: invalid quoted value in %s", expr)
+		}
+		f.Value = v
+	}
+	if num, err := strconv.ParseFloat(f.Value, 64); err == nil {
+		f.num, f.isNum = num, true
+	}
+	switch f.Op {
+	case "=~", "!~":
+		reg, err := regexp.Compile(f.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "config.ParseFilter: compile filter regexp failed: %s", expr)
+		}
+		f.reg = reg
+	case ">", ">=", "<", "<=":
+		if !f.isNum {
+			return nil, errors.Errorf("config.ParseFilter: %s requires a numeric value: %s", f.Op, expr)
+		}
+	}
+	return f, nil
+}
+
+// Match 判断字段的值是否满足过滤条件, 数字之间按数值比较
+func (f *Filter) Match(v string) bool {
+	switch f.Op {
+	case "=~":
+		return f.reg.MatchString(v)
+	case "!~":
+		return !f.reg.MatchString(v)
+	}
+	num, err := strconv.ParseFloat(v, 64)
+	isNum := err == nil && f.isNum
+	switch f.Op {
+	case "==":
+		return v == f.Value || isNum && num == f.num
+	case "!=":
+		return !(v == f.Value || isNum && num == f.num)
+	case ">":
+		return isNum && num > f.num
+	case ">=":
+		return isNum && num >= f.num
+	case "<":
+		return isNum && num < f.num
+	case "<=":
+		return isNum && num <= f.num
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"log2metrics/src/common"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// 预置日志格式对应的grok pattern, 顶层的字段名即可以在value_field/tags/filters中引用的字段
+// nginx_combined兼容在combined之后追加$request_time $upstream_response_time的常见配置,
+// 以及自带的nginx_log_generator将status写为[code=200]的格式
+var formatPresets = map[string]string{
+	common.FormatNginxCombined: `^%{IPORHOST:remote_addr} - %{NOTSPACE:remote_user} \[%{HTTPDATE:time_local}\] ` +
+		`"%{WORD:method} %{NOTSPACE:path}(?: HTTP/%{NUMBER:http_version})?" (?:\[code=)?%{INT:status}\]? (?:%{INT:bytes}|-)` +
+		`(?: "%{DATA:referer}" "%{DATA:user_agent}")?(?: %{NUMBER:request_time})?(?: (?:%{NUMBER:upstream_time}|-)\S*)?`,
+	common.FormatApacheCommon: `^%{IPORHOST:remote_addr} %{HTTPDUSER:ident} %{HTTPDUSER:remote_user} \[%{HTTPDATE:time_local}\] ` +
+		`"%{WORD:method} %{NOTSPACE:path}(?: HTTP/%{NUMBER:http_version})?" %{INT:status} (?:%{INT:bytes}|-)`,
+	common.FormatSyslogRFC3164: `^(?:<%{NONNEGINT:priority}>)?%{SYSLOGTIMESTAMP:timestamp} %{SYSLOGHOST:host} ` +
+		`%{PROG:program}(?:\[%{POSINT:pid}\])?: ?%{GREEDYDATA:message}`,
+	common.FormatSyslogRFC5424: `^<%{NONNEGINT:priority}>%{NONNEGINT:version} (?:%{TIMESTAMP_ISO8601:timestamp}|-) ` +
+		`%{NOTSPACE:host} %{NOTSPACE:app_name} %{NOTSPACE:procid} %{NOTSPACE:msgid} (?:-|(?:\[(?:[^\]\\]|\\.)*\])+)(?: %{GREEDYDATA:message})?`,
+}
+
+// format日志: 使用预置的格式解析, value_field/tags/filters中的字段均为预置格式的字段名
+func setFormatParser(st *LogStrategy, grok grokLibrary) error {
+	if st.Pattern != "" {
+		return errors.Errorf("config.setFormatParser: pattern is not used by format %s: %s", st.Format, st.MetricName)
+	}
+	preset, ok := formatPresets[st.Format]
+	if !ok {
+		return errors.Errorf("config.setFormatParser: unknown format %s of metric %s", st.Format, st.MetricName)
+	}
+	expanded, err := grok.expand(preset)
+	if err != nil {
+		return errors.Wrapf(err, "config.setFormatParser: expand format %s failed", st.Format)
+	}
+	reg, err := regexp.Compile(expanded)
+	if err != nil {
+		return errors.Wrapf(err, "config.setFormatParser: compile format %s failed", st.Format)
+	}
+	st.PatternReg = reg
+
+	// 校验引用的字段都存在于预置格式中
+	fields := make(map[string]bool)
+	for _, name := range reg.SubexpNames() {
+		fields[name] = name != ""
+	}
+	if st.ValueField != "" && !fields[st.ValueField] {
+		return errors.Errorf("config.setFormatParser: unknown value_field %s of format %s", st.ValueField, st.Format)
+	}
+	for _, field := range st.Tags {
+		if !fields[field] {
+			return errors.Errorf("config.setFormatParser: unknown tag field %s of format %s", field, st.Format)
+		}
+	}
+	for _, expr := range st.Filters {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			return err
+		}
+		if !fields[f.Field] {
+			return errors.Errorf("config.setFormatParser: unknown filter field %s of format %s", f.Field, st.Format)
+		}
+		st.FilterRules = append(st.FilterRules, f)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// grok引用: %{NAME}, %{NAME:field}, %{NAME:field:type}, type仅为兼容保留, 数值统一按float处理
+var grokRefReg = regexp.MustCompile(`%\{(\w+)(?::(\w+))?(?::(?:int|float|string))?\}`)
+
+// grok展开的最大嵌套层数, 避免pattern之间循环引用
+const grokMaxDepth = 32
+
+// 内置的grok pattern库, 基于logstash的grok-patterns改写为RE2支持的语法(去掉了环视及原子分组)
+var grokBuiltin = map[string]string{
+	"USERNAME":           `[a-zA-Z0-9._-]+`,
+	"USER":               `%{USERNAME}`,
+	"EMAILLOCALPART":     `[a-zA-Z][a-zA-Z0-9_.+-=:]+`,
+	"EMAILADDRESS":       `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":                `[+-]?[0-9]+`,
+	"BASE10NUM":          `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":             `%{BASE10NUM}`,
+	"BASE16NUM":          `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"BASE16FLOAT":        `[+-]?(?:0x)?(?:[0-9A-Fa-f]+(?:\.[0-9A-Fa-f]*)?|\.[0-9A-Fa-f]+)`,
+	"POSINT":             `[1-9][0-9]*`,
+	"NONNEGINT":          `[0-9]+`,
+	"WORD":               `\w+`,
+	"NOTSPACE":           `\S+`,
+	"SPACE":              `\s*`,
+	"DATA":               `.*?`,
+	"GREEDYDATA":         `.*`,
+	"QUOTEDSTRING":       `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` + "`(?:[^`\\\\]|\\\\.)*`",
+	"UUID":               `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":                `%{CISCOMAC}|%{WINDOWSMAC}|%{COMMONMAC}`,
+	"CISCOMAC":           `(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4}`,
+	"WINDOWSMAC":         `(?:[A-Fa-f0-9]{2}-){5}[A-Fa-f0-9]{2}`,
+	"COMMONMAC":          `(?:[A-Fa-f0-9]{2}:){5}[A-Fa-f0-9]{2}`,
+	"IPV6":               `(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{1,4}:){1,7}:|(?:[0-9A-Fa-f]{1,4}:){1,6}:[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{1,4}:){1,5}(?::[0-9A-Fa-f]{1,4}){1,2}|(?:[0-9A-Fa-f]{1,4}:){1,4}(?::[0-9A-Fa-f]{1,4}){1,3}|(?:[0-9A-Fa-f]{1,4}:){1,3}(?::[0-9A-Fa-f]{1,4}){1,4}|(?:[0-9A-Fa-f]{1,4}:){1,2}(?::[0-9A-Fa-f]{1,4}){1,5}|[0-9A-Fa-f]{1,4}:(?::[0-9A-Fa-f]{1,4}){1,6}|:(?:(?::[0-9A-Fa-f]{1,4}){1,7}|:)|(?:[0-9A-Fa-f]{1,4}:){6}%{IPV4}|::(?:[fF]{4}:)?%{IPV4}`,
+	"IPV4":               `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IP":                 `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":           `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":           `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT":           `%{IPORHOST}:%{POSINT}`,
+	"PATH":               `%{UNIXPATH}|%{WINPATH}`,
+	"UNIXPATH":           `(?:/[\w_%!$@:.,+~-]*)+`,
+	"TTY":                `/dev/(?:pts|tty[pq])(?:\w+)?/?(?:[0-9]+)`,
+	"WINPATH":            `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"URIPROTO":           `[A-Za-z][A-Za-z0-9+\-.]*`,
+	"URIHOST":            `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":            `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIQUERY":           `[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPARAM":           `\?%{URIQUERY}`,
+	"URIPATHPARAM":       `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":                `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+	"MONTH":              `\b(?:[Jj]an(?:uary|uar)?|[Ff]eb(?:ruary|ruar)?|[Mm](?:a|ä)?r(?:ch|z)?|[Aa]pr(?:il)?|[Mm]a(?:y|i)?|[Jj]un(?:e|i)?|[Jj]ul(?:y|i)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo](?:c|k)?t(?:ober)?|[Nn]ov(?:ember)?|[Dd]e(?:c|z)(?:ember)?)\b`,
+	"MONTHNUM":           `0?[1-9]|1[0-2]`,
+	"MONTHNUM2":          `0[1-9]|1[0-2]`,
+	"MONTHDAY":           `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":                `Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?`,
+	"YEAR":               `(?:\d\d){1,2}`,
+	"HOUR":               `2[0123]|[01]?[0-9]`,
+	"MINUTE":             `[0-5][0-9]`,
+	"SECOND":             `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":               `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":            `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":            `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"ISO8601_TIMEZONE":   `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"ISO8601_SECOND":     `%{SECOND}`,
+	"TIMESTAMP_ISO8601":  `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"DATE":               `%{DATE_US}|%{DATE_EU}`,
+	"DATESTAMP":          `%{DATE}[- ]%{TIME}`,
+	"TZ":                 `[A-Z]{3}`,
+	"DATESTAMP_RFC822":   `%{DAY} %{MONTH} %{MONTHDAY} %{YEAR} %{TIME} %{TZ}`,
+	"DATESTAMP_OTHER":    `%{DAY} %{MONTH} %{MONTHDAY} %{TIME} %{TZ} %{YEAR}`,
+	"HTTPDATE":           `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":    `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"PROG":               `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGPROG":         `%{PROG}(?:\[%{POSINT}\])?`,
+	"SYSLOGHOST":         `%{IPORHOST}`,
+	"SYSLOGFACILITY":     `<%{NONNEGINT}.%{NONNEGINT}>`,
+	"SYSLOGBASE":         `%{SYSLOGTIMESTAMP} (?:%{SYSLOGFACILITY} )?%{SYSLOGHOST} %{SYSLOGPROG}:`,
+	"LOGLEVEL":           `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn?(?:ing)?|WARN?(?:ING)?|[Ee]rr?(?:or)?|ERR?(?:OR)?|[Cc]rit?(?:ical)?|CRIT?(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?`,
+	"HTTPDUSER":          `%{EMAILADDRESS}|%{USER}`,
+	"COMMONAPACHELOG":    `%{IPORHOST} %{HTTPDUSER} %{HTTPDUSER} \[%{HTTPDATE}\] "(?:%{WORD} %{NOTSPACE}(?: HTTP/%{NUMBER})?|%{DATA})" %{NUMBER} (?:%{NUMBER}|-)`,
+	"COMBINEDAPACHELOG":  `%{COMMONAPACHELOG} %{QUOTEDSTRING} %{QUOTEDSTRING}`,
+	"JAVACLASS":          `(?:[a-zA-Z$_][a-zA-Z$_0-9]*\.)*[a-zA-Z$_][a-zA-Z$_0-9]*`,
+	"JAVAFILE":           `[A-Za-z0-9_. -]+`,
+	"JAVAMETHOD":         `<init>|[a-zA-Z$_][a-zA-Z$_0-9]*`,
+	"JAVASTACKTRACEPART": `\s*at %{JAVACLASS}\.%{JAVAMETHOD}\(%{JAVAFILE}(?::%{NUMBER})?\)`,
+	"JAVATHREAD":         `[A-Z]{2}-Processor[\d]+`,
+	"JAVALOGMESSAGE":     `.*`,
+}
+
+// grokLibrary grok pattern名称到正则的映射
+type grokLibrary map[string]string
+
+// 加载内置的grok pattern库以及用户的pattern文件, 同名时用户定义覆盖内置
+// pattern文件每行格式为 NAME regexp, 空行及#开头的行忽略
+func newGrokLibrary(files []string) (grokLibrary, error) {
+	lib := make(grokLibrary, len(grokBuiltin))
+	for k, v := range grokBuiltin {
+		lib[k] = v
+	}
+	for _, file := range files {
+		if err := lib.load(file); err != nil {
+			return lib, err
+		}
+	}
+	return lib, nil
+}
+
+func (g grokLibrary) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "config.grokLibrary: open pattern file failed: %s", file)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return errors.Errorf("config.grokLibrary: invalid pattern line %q in %s", line, file)
+		}
+		g[fields[0]] = strings.TrimSpace(fields[1])
+	}
+	return errors.Wrapf(scanner.Err(), "config.grokLibrary: read pattern file failed: %s", file)
+}
+
+// IsGrok 判断pattern中是否包含grok引用
+func IsGrok(pattern string) bool {
+	return grokRefReg.MatchString(pattern)
+}
+
+// 将grok pattern展开为正则, 只有pattern中直接书写的%{NAME:field}会生成命名分组,
+// pattern库内部的字段名不会生成命名分组, 避免时间戳等字段变成高基数的标签
+func (g grokLibrary) expand(pattern string) (string, error) {
+	return g.expandDepth(pattern, true, 0)
+}
+
+func (g grokLibrary) expandDepth(pattern string, named bool, depth int) (string, error) {
+	if depth > grokMaxDepth {
+		return "", errors.Errorf("config.grokLibrary: pattern nested too deep, maybe a reference cycle: %s", pattern)
+	}
+	var err error
+	res := grokRefReg.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		m := grokRefReg.FindStringSubmatch(ref)
+		def, ok := g[m[1]]
+		if !ok {
+			err = errors.Errorf("config.grokLibrary: unknown grok pattern %s", m[1])
+			return ""
+		}
+		var sub string
+		if sub, err = g.expandDepth(def, false, depth+1); err != nil {
+			return ""
+		}
+		if named && m[2] != "" {
+			return "(?P<" + m[2] + ">" + sub + ")"
+		}
+		return "(?:" + sub + ")"
+	})
+	return res, err
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JSONPath json字段路径, 如 $.http.status 或 items[0].name, 开头的$可省略
+type JSONPath struct {
+	Expr  string
+	steps []jsonStep
+}
+
+type jsonStep struct {
+	key   string
+	index int // key为空时表示数组下标
+}
+
+// ParseJSONPath 解析json字段路径
+func ParseJSONPath(expr string) (*JSONPath, error) {
+	p := &JSONPath{Expr: expr}
+	s := strings.TrimPrefix(strings.TrimSpace(expr), "$")
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, errors.Errorf("config.ParseJSONPath: unclosed bracket in %s", expr)
+			}
+			idx, err := strconv.Atoi(s[1:end])
+			if err != nil || idx < 0 {
+				return nil, errors.Errorf("config.ParseJSONPath: invalid array index %s in %s", s[1:end], expr)
+			}
+			p.steps = append(p.steps, jsonStep{index: idx})
+			s = s[end+1:]
+		default:
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			p.steps = append(p.steps, jsonStep{key: s[:end]})
+			s = s[end:]
+		}
+	}
+	if len(p.steps) == 0 {
+		return nil, errors.Errorf("config.ParseJSONPath: empty path %s", expr)
+	}
+	return p, nil
+}
+
+// Get 获取json文档中路径对应的值, 路径不存在时返回false
+func (p *JSONPath) Get(doc interface{}) (interface{}, bool) {
+	cur := doc
+	for _, st := range p.steps {
+		if st.key != "" {
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if cur, ok = m[st.key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		arr, ok := cur.([]interface{})
+		if !ok || st.index >= len(arr) {
+			return nil, false
+		}
+		cur = arr[st.index]
+	}
+	return cur, true
+}
+
+// JSONString 将json的值转换为字符串, 对象和数组保持json格式
+func JSONString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	bs, _ := json.Marshal(v)
+	return string(bs)
+}
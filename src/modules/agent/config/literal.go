@@ -0,0 +1,54 @@
+package config
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+// requiredLiterals 提取正则匹配时必然出现在日志中的字面量, 用于在执行正则之前快速排除不可能匹配的行
+// 只处理区分大小写的字面量, 分支/可选部分中的字面量不是必然出现的, 不提取
+func requiredLiterals(reg *regexp.Regexp) []string {
+	if reg == nil {
+		return nil
+	}
+	re, err := syntax.Parse(reg.String(), syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	var (
+		res  []string
+		seen = make(map[string]bool)
+	)
+	for _, literal := range collectLiterals(re.Simplify()) {
+		// 单个字节几乎每行都会出现, 没有过滤效果
+		if len(literal) < 2 || seen[literal] {
+			continue
+		}
+		seen[literal] = true
+		res = append(res, literal)
+	}
+	return res
+}
+
+func collectLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return collectLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return collectLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		var res []string
+		for _, sub := range re.Sub {
+			res = append(res, collectLiterals(sub)...)
+		}
+		return res
+	}
+	return nil
+}
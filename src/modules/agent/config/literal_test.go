@@ -0,0 +1,68 @@
+package config
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequiredLiterals(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+		want    []string
+	}{
+		{"concat", `code=(\d+) cost=(\d+)ms`, []string{"code=", " cost=", "ms"}},
+		{"single byte dropped", `a(\d+)=`, nil},
+		{"duplicate", `id=(\d+),id=(\d+)`, []string{"id=", ",id="}},
+		// 分支中的字面量不是必然出现的, 公共前缀会被提取出来
+		{"alternation", `(GET|POST) /api/`, []string{" /api/"}},
+		{"alternation common prefix", `level=(warn|warning|error)`, []string{"level="}},
+		{"alternation factored", `req(abc|abd)`, []string{"req", "ab"}},
+		{"quest", `status=(\d+)( cached)?`, []string{"status="}},
+		{"star", `user(name)* id=`, []string{"user", " id="}},
+		{"plus", `(ab)+cd`, []string{"ab", "cd"}},
+		{"repeat zero", `req(abc){0,3}end`, []string{"req", "end"}},
+		{"repeat at least once", `(abc){2,3}end`, []string{"abc", "end"}},
+		{"fold case", `(?i)error code`, nil},
+		{"fold case group", `(?i:error) code=`, []string{" code="}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := requiredLiterals(regexp.MustCompile(c.pattern))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("requiredLiterals(%q) = %q, want %q", c.pattern, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRequiredLiteralsNil(t *testing.T) {
+	if got := requiredLiterals(nil); got != nil {
+		t.Errorf("requiredLiterals(nil) = %q, want nil", got)
+	}
+}
+
+// 提取出的字面量必须出现在每一个能匹配正则的行中
+func TestRequiredLiteralsSound(t *testing.T) {
+	reg := regexp.MustCompile(`\[code=(5\d\d)\] (\d+) "(GET|POST)`)
+	lines := []string{
+		`1.1.1.1 - - [29/Dec/2021:22:01:14 +0800] "GET /a.php HTTP/1.1" [code=502] 76 "GET`,
+		`[code=500] 1 "POST`,
+	}
+	literals := requiredLiterals(reg)
+	if len(literals) == 0 {
+		t.Fatalf("requiredLiterals(%q) returned no literal", reg)
+	}
+	for _, line := range lines {
+		if !reg.MatchString(line) {
+			t.Fatalf("pattern does not match %q", line)
+		}
+		for _, literal := range literals {
+			if !strings.Contains(line, literal) {
+				t.Errorf("literal %q missing in matched line %q", literal, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"log2metrics/src/common"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Multiline 多行日志的组装配置, 组装后的事件内各行以\n连接, pattern需要使用(?s)等方式跨行匹配
+type Multiline struct {
+	// 匹配start_pattern的行开始一个新事件, 其余行追加到当前事件
+	StartPattern string `json:"start_pattern" yaml:"start_pattern"`
+	// 匹配continue_pattern的行追加到当前事件, 其余行开始一个新事件
+	ContinuePattern string        `json:"continue_pattern" yaml:"continue_pattern"`
+	MaxLines        int           `json:"max_lines" yaml:"max_lines"`         // 单个事件的最大行数, 超过后开始新事件
+	FlushTimeout    time.Duration `json:"flush_timeout" yaml:"flush_timeout"` // 超过该时间没有新行时推送当前事件
+
+	StartReg    *regexp.Regexp `json:"-" yaml:"-"`
+	ContinueReg *regexp.Regexp `json:"-" yaml:"-"`
+}
+
+// 校验multiline配置并设置默认值
+func setMultiline(st *LogStrategy) error {
+	ml := st.Multiline
+	if ml == nil {
+		return nil
+	}
+	if ml.StartPattern == "" && ml.ContinuePattern == "" {
+		return errors.Errorf("config.setMultiline: start_pattern or continue_pattern is required: %s", st.MetricName)
+	}
+	if ml.StartPattern != "" {
+		reg, err := regexp.Compile(ml.StartPattern)
+		if err != nil {
+			return errors.Wrapf(err, "config.setMultiline: compile start_pattern failed: %s", ml.StartPattern)
+		}
+		ml.StartReg = reg
+	}
+	if ml.ContinuePattern != "" {
+		reg, err := regexp.Compile(ml.ContinuePattern)
+		if err != nil {
+			return errors.Wrapf(err, "config.setMultiline: compile continue_pattern failed: %s", ml.ContinuePattern)
+		}
+		ml.ContinueReg = reg
+	}
+	if ml.MaxLines <= 0 {
+		ml.MaxLines = common.MultilineMaxLines
+	}
+	if ml.FlushTimeout <= 0 {
+		ml.FlushTimeout = common.MultilineFlushTimeout
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"log2metrics/src/common"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Histogram func为histogram时的桶配置, buckets与exponential二选一, 都为空时使用prometheus默认桶
+// 配置native时同时导出原生直方图, 此时没有配置buckets/exponential则只导出原生直方图
+type Histogram struct {
+	Buckets     []float64           `json:"buckets" yaml:"buckets"`
+	Exponential *ExponentialBuckets `json:"exponential" yaml:"exponential"`
+	Native      *NativeHistogram    `json:"native" yaml:"native"`
+}
+
+// ExponentialBuckets 指数桶, 从start开始每个桶上限乘以factor, 共count个
+type ExponentialBuckets struct {
+	Start  float64 `json:"start" yaml:"start"`
+	Factor float64 `json:"factor" yaml:"factor"`
+	Count  int     `json:"count" yaml:"count"`
+}
+
+// NativeHistogram prometheus原生直方图, 桶边界按bucket_factor自动生成
+// 只能通过protobuf格式抓取, prometheus需要开启native-histograms特性
+type NativeHistogram struct {
+	BucketFactor     float64       `json:"bucket_factor" yaml:"bucket_factor"`           // 相邻桶上限的最大比例, 需大于1
+	MaxBuckets       uint32        `json:"max_buckets" yaml:"max_buckets"`               // 桶数量上限, 超过时降低精度
+	MinResetDuration time.Duration `json:"min_reset_duration" yaml:"min_reset_duration"` // 桶数量超限时, 距上次重置超过该时间则重置直方图
+}
+
+// Summary func为summary时的分位数配置
+type Summary struct {
+	Quantiles []float64     `json:"quantiles" yaml:"quantiles"` // 分位数, 如 0.5/0.9/0.99
+	MaxAge    time.Duration `json:"max_age" yaml:"max_age"`     // 分位数统计的时间窗口
+}
+
+// 校验histogram/summary配置并设置默认值
+func setObserve(st *LogStrategy) error {
+	switch st.Func {
+	case common.LogFuncHistogram:
+		if st.Histogram == nil {
+			st.Histogram = &Histogram{}
+		}
+		if e := st.Histogram.Exponential; e != nil {
+			if len(st.Histogram.Buckets) != 0 {
+				return errors.Errorf("config.setObserve: buckets and exponential are mutually exclusive: %s", st.MetricName)
+			}
+			if e.Start <= 0 || e.Factor <= 1 || e.Count < 1 {
+				return errors.Errorf("config.setObserve: exponential buckets need start > 0, factor > 1 and count >= 1: %s", st.MetricName)
+			}
+		}
+		for i := 1; i < len(st.Histogram.Buckets); i++ {
+			if st.Histogram.Buckets[i] <= st.Histogram.Buckets[i-1] {
+				return errors.Errorf("config.setObserve: histogram buckets must be in increasing order: %s", st.MetricName)
+			}
+		}
+		if n := st.Histogram.Native; n != nil {
+			if n.BucketFactor == 0 {
+				n.BucketFactor = common.NativeHistogramBucketFactor
+			}
+			if n.BucketFactor <= 1 {
+				return errors.Errorf("config.setObserve: native histogram bucket_factor must be > 1: %s", st.MetricName)
+			}
+			if n.MaxBuckets == 0 {
+				n.MaxBuckets = common.NativeHistogramMaxBuckets
+			}
+			if n.MinResetDuration == 0 {
+				n.MinResetDuration = common.NativeHistogramMinResetDuration
+			}
+		}
+	case common.LogFuncSummary:
+		if st.Summary == nil {
+			st.Summary = &Summary{}
+		}
+		if len(st.Summary.Quantiles) == 0 {
+			st.Summary.Quantiles = common.SummaryQuantiles
+		}
+		for _, q := range st.Summary.Quantiles {
+			if q <= 0 || q >= 1 {
+				return errors.Errorf("config.setObserve: summary quantile must be in (0, 1): %s", st.MetricName)
+			}
+		}
+	}
+	return nil
+}
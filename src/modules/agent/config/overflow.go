@@ -0,0 +1,40 @@
+package config
+
+import (
+	"log2metrics/src/common"
+
+	"github.com/pkg/errors"
+)
+
+// Overflow Stream满时的处理策略
+type Overflow struct {
+	// block: 阻塞读取, 降低tailer的读取速度
+	// drop_newest(默认): 丢弃新读取到的行
+	// drop_oldest: 丢弃Stream中最早的行
+	// spill: 溢出的行写入本地磁盘队列, Stream有空闲时再读回
+	Policy        string `json:"policy" yaml:"policy"`
+	SpillDir      string `json:"spill_dir" yaml:"spill_dir"`             // 磁盘队列目录
+	SpillMaxBytes int64  `json:"spill_max_bytes" yaml:"spill_max_bytes"` // 磁盘队列上限, 超过后丢弃
+}
+
+// 校验overflow配置并设置默认值
+func setOverflow(st *LogStrategy) error {
+	if st.Overflow == nil {
+		st.Overflow = &Overflow{}
+	}
+	switch st.Overflow.Policy {
+	case "":
+		st.Overflow.Policy = common.OverflowDropNewest
+	case common.OverflowBlock, common.OverflowDropNewest, common.OverflowDropOldest:
+	case common.OverflowSpill:
+		if st.Overflow.SpillDir == "" {
+			st.Overflow.SpillDir = common.SpillDir
+		}
+		if st.Overflow.SpillMaxBytes <= 0 {
+			st.Overflow.SpillMaxBytes = common.SpillMaxBytes
+		}
+	default:
+		return errors.Errorf("config.setOverflow: unknown overflow policy: %s", st.Overflow.Policy)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"log"
+	"log2metrics/src/common"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// 根据日志解析方式编译主正则/tags正则或结构化日志的字段路径
+func setParser(st *LogStrategy, grok grokLibrary) error {
+	st.TagRegs = make(map[string]*regexp.Regexp)
+	st.TagPaths = make(map[string]*JSONPath)
+	// 配置了预置格式时使用format解析
+	if st.Format != "" {
+		if st.Parser != "" && st.Parser != common.ParserFormat {
+			return errors.Errorf("config.setParser: format can not be used with parser %s: %s", st.Parser, st.MetricName)
+		}
+		st.Parser = common.ParserFormat
+	}
+	switch st.Parser {
+	case "":
+		st.Parser = common.ParserRegex
+		return setRegexParser(st, grok)
+	case common.ParserRegex:
+		return setRegexParser(st, grok)
+	case common.ParserJSON:
+		return setJSONParser(st)
+	case common.ParserLogfmt:
+		return setLogfmtParser(st)
+	case common.ParserFormat:
+		return setFormatParser(st, grok)
+	}
+	return errors.Errorf("config.setParser: unknown parser %s of metric %s", st.Parser, st.MetricName)
+}
+
+func setRegexParser(st *LogStrategy, grok grokLibrary) error {
+	if st.ValueField != "" || len(st.Filters) != 0 {
+		return errors.Errorf("config.setRegexParser: value_field and filters require a structured parser: %s", st.MetricName)
+	}
+	if len(st.Pattern) != 0 {
+		pattern := st.Pattern
+		// grok pattern展开为带命名分组的正则
+		if IsGrok(pattern) {
+			expanded, err := grok.expand(pattern)
+			if err != nil {
+				return errors.Wrapf(err, "config.setRegexParser: expand grok pattern failed: %s", st.MetricName)
+			}
+			st.ExpandedPattern = expanded
+			pattern = expanded
+		}
+		// 编译正则表达式
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "config.setRegexParser: compile pattern regexp failed: %s", st.Pattern)
+		}
+		st.PatternReg = reg
+	}
+	// 处理主正则的命名分组
+	if err := setPatternGroups(st); err != nil {
+		return err
+	}
+	// 处理tags正则, 编译失败的tag直接跳过
+	for tagK, tagV := range st.Tags {
+		reg, err := regexp.Compile(tagV)
+		if err != nil {
+			log.Printf("%+v", errors.Wrapf(err, "config.setRegexParser: compile tags pattern regexp failed: %s", tagV))
+			continue
+		}
+		st.TagRegs[tagK] = reg
+	}
+	return nil
+}
+
+// json日志: value_field/tags/filters中的字段均为json路径
+func setJSONParser(st *LogStrategy) error {
+	if st.Pattern != "" {
+		return errors.Errorf("config.setJSONParser: pattern is not used by parser json: %s", st.MetricName)
+	}
+	if st.ValueField != "" {
+		p, err := ParseJSONPath(st.ValueField)
+		if err != nil {
+			return err
+		}
+		st.ValuePath = p
+	}
+	for tagK, tagV := range st.Tags {
+		p, err := ParseJSONPath(tagV)
+		if err != nil {
+			return err
+		}
+		st.TagPaths[tagK] = p
+	}
+	for _, expr := range st.Filters {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			return err
+		}
+		if f.Path, err = ParseJSONPath(f.Field); err != nil {
+			return err
+		}
+		st.FilterRules = append(st.FilterRules, f)
+	}
+	return nil
+}
+
+// logfmt日志: value_field/tags/filters中的字段均为key
+func setLogfmtParser(st *LogStrategy) error {
+	if st.Pattern != "" {
+		return errors.Errorf("config.setLogfmtParser: pattern is not used by parser logfmt: %s", st.MetricName)
+	}
+	for _, expr := range st.Filters {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			return err
+		}
+		st.FilterRules = append(st.FilterRules, f)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ReadFromEnd       = "end"
+	ReadFromBeginning = "beginning"
+	readFromOffset    = "offset:"
+	readFromTime      = "time:"
+)
+
+// ReadPosition 解析read_from后得到的文件起始读取位置
+type ReadPosition struct {
+	Whence int   // io.SeekStart / io.SeekEnd
+	Offset int64 // Whence为io.SeekStart时相对文件头部的偏移
+	// Since非零时从头读取, 并跳过日志时间早于Since的行
+	Since      time.Time
+	TimeReg    *regexp.Regexp
+	TimeLayout string
+}
+
+// ParseTime 使用TimeReg的第一个分组提取日志时间, 并按TimeLayout进行解析
+func (p *ReadPosition) ParseTime(line string) (time.Time, bool) {
+	v := p.TimeReg.FindStringSubmatch(line)
+	if len(v) < 2 {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(p.TimeLayout, v[1], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// 解析read_from配置
+//
+//	end(默认): 从文件尾部开始读取
+//	beginning: 从文件头部开始读取
+//	offset:<n> 或 <n>: 从第n个字节开始读取
+//	time:<RFC3339时间> 或 time:<-duration>: 只读取日志时间晚于该时间的行, 需要配置time_pattern和time_layout
+func parseReadFrom(st *LogStrategy) (*ReadPosition, error) {
+	readFrom := strings.TrimSpace(st.ReadFrom)
+	switch {
+	case readFrom == "" || readFrom == ReadFromEnd:
+		return &ReadPosition{Whence: io.SeekEnd}, nil
+	case readFrom == ReadFromBeginning:
+		return &ReadPosition{Whence: io.SeekStart}, nil
+	case strings.HasPrefix(readFrom, readFromTime):
+		return parseReadFromTime(st, strings.TrimPrefix(readFrom, readFromTime))
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimPrefix(readFrom, readFromOffset), 10, 64)
+	if err != nil || offset < 0 {
+		return nil, errors.Errorf("config.parseReadFrom: invalid read_from: %s", st.ReadFrom)
+	}
+	return &ReadPosition{Whence: io.SeekStart, Offset: offset}, nil
+}
+
+func parseReadFromTime(st *LogStrategy, v string) (*ReadPosition, error) {
+	if st.TimePattern == "" || st.TimeLayout == "" {
+		return nil, errors.Errorf("config.parseReadFrom: time_pattern and time_layout are required when read_from is time: %s", st.ReadFrom)
+	}
+	var since time.Time
+	// 负数duration表示相对当前时间, 如 time:-1h
+	if d, err := time.ParseDuration(v); err == nil {
+		since = time.Now().Add(d)
+	} else if since, err = time.Parse(time.RFC3339, v); err != nil {
+		return nil, errors.Wrapf(err, "config.parseReadFrom: invalid read_from time: %s", st.ReadFrom)
+	}
+	reg, err := regexp.Compile(st.TimePattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "config.parseReadFrom: compile time_pattern regexp failed: %s", st.TimePattern)
+	}
+	return &ReadPosition{
+		Whence:     io.SeekStart,
+		Since:      since,
+		TimeReg:    reg,
+		TimeLayout: st.TimeLayout,
+	}, nil
+}
+
+// 同一个文件的多个策略共享一个reader, read_from只在reader启动时生效
+// 热加载新增或修改的策略加入已经在读取的文件时从当前位置开始读取, 配置了read_from的策略在加载时提示
+func warnSharedReadFrom(ss []*LogStrategy) {
+	files := make(map[string]int)
+	for _, st := range ss {
+		files[st.FilePath]++
+	}
+	for _, st := range ss {
+		if files[st.FilePath] > 1 && st.ReadPosition.Whence != io.SeekEnd {
+			log.Printf("[WARN][config.ParseStrategies: read_from only applies when the shared reader of the file starts, "+
+				"a strategy added by hot reload while the file is being read starts at the current position][name:%s][file:%s][read_from:%s]",
+				st.MetricName, st.FilePath, st.ReadFrom)
+		}
+	}
+}
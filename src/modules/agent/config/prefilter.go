@@ -0,0 +1,27 @@
+package config
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// 编译exclude正则, contains为字面量无需处理
+// 同时提取主正则必然包含的字面量, Reader用来合并同一文件的全部策略在一次扫描中完成预过滤
+func setPrefilter(st *LogStrategy) error {
+	st.ExcludeRegs = nil
+	for _, expr := range st.Exclude {
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			return errors.Wrapf(err, "config.setPrefilter: compile exclude regexp failed: %s", expr)
+		}
+		st.ExcludeRegs = append(st.ExcludeRegs, reg)
+	}
+	for _, literal := range st.Contains {
+		if literal == "" {
+			return errors.Errorf("config.setPrefilter: empty contains literal of metric %s", st.MetricName)
+		}
+	}
+	st.Literals = requiredLiterals(st.PatternReg)
+	return nil
+}
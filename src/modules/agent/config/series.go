@@ -0,0 +1,22 @@
+package config
+
+import (
+	"log2metrics/src/common"
+
+	"github.com/pkg/errors"
+)
+
+// 校验series数量限制配置
+func setSeriesLimit(st *LogStrategy) error {
+	if st.MaxSeries < 0 {
+		return errors.Errorf("config.setSeriesLimit: invalid max_series %d of metric %s", st.MaxSeries, st.MetricName)
+	}
+	switch st.SeriesOverflow {
+	case "":
+		st.SeriesOverflow = common.SeriesOverflowFold
+	case common.SeriesOverflowFold, common.SeriesOverflowDrop:
+	default:
+		return errors.Errorf("config.setSeriesLimit: unknown series_overflow %s of metric %s", st.SeriesOverflow, st.MetricName)
+	}
+	return nil
+}
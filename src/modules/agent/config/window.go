@@ -0,0 +1,27 @@
+package config
+
+import (
+	"log2metrics/src/common"
+
+	"github.com/pkg/errors"
+)
+
+// 校验max/min/avg的统计窗口配置
+func setWindow(st *LogStrategy) error {
+	if st.Window <= 0 {
+		return nil
+	}
+	switch st.Func {
+	case common.LogFuncMax, common.LogFuncMin, common.LogFuncAvg:
+	default:
+		return errors.Errorf("config.setWindow: window only applies to max/min/avg: %s", st.MetricName)
+	}
+	switch st.WindowType {
+	case "":
+		st.WindowType = common.WindowTumbling
+	case common.WindowTumbling, common.WindowSliding:
+	default:
+		return errors.Errorf("config.setWindow: unknown window_type %s of metric %s", st.WindowType, st.MetricName)
+	}
+	return nil
+}
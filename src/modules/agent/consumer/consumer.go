@@ -3,12 +3,18 @@ package consumer
 import (
 	"bytes"
 	"log"
+	"log2metrics/src/common"
 	"log2metrics/src/modules/agent/config"
+	"log2metrics/src/modules/metrics"
 	"math"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Consumer consumer 对象
@@ -18,17 +24,138 @@ type Consumer struct {
 	Strategy     *config.LogStrategy
 	Mark         string // worker name
 	Close        chan struct{}
-	CounterQueue chan *AnalysisPoint // 统计Queue
-	IsAnalysing  bool                // 判断是否正在分析
+	CounterQueue chan []*AnalysisPoint // 统计Queue
+	IsAnalysing  bool                  // 判断是否正在分析
+	metrics      *consumerMetrics      // 自身运行指标, 消费者组内共用
+	fingerprint  string                // 策略指纹, 随AnalysisPoint推送
+
+	// 本地按series预聚合的AnalysisPoint, key为标签排序的结果, 定期或行数达到上限时批量推送
+	batch      map[string]*AnalysisPoint
+	batchLines int
+}
+
+// consumerMetrics 消费者的自身运行指标
+type consumerMetrics struct {
+	matched     prometheus.Counter
+	unmatched   prometheus.Counter
+	contains    prometheus.Counter // 没有包含contains字面量而被过滤的行数
+	exclude     prometheus.Counter // 匹配exclude正则而被过滤的行数
+	panics      prometheus.Counter
+	latency     prometheus.Observer
+	streamDepth prometheus.Gauge
+	tagMisses   map[string]prometheus.Counter
+}
+
+// sharedSeries 只按metric_name区分的指标(analysis耗时、tag未匹配次数)由同一metric的多个消费者组共用,
+// 按标签值引用计数, 最后一个消费者组停止时才删除
+var sharedSeries = struct {
+	sync.Mutex
+	refs map[sharedKey]int
+}{refs: make(map[sharedKey]int)}
+
+type sharedKey struct {
+	metricName string
+	tag        string // 为空时表示analysis耗时
+}
+
+func newConsumerMetrics(filePath string, strategy *config.LogStrategy) *consumerMetrics {
+	sharedSeries.Lock()
+	defer sharedSeries.Unlock()
+	sharedSeries.refs[sharedKey{metricName: strategy.MetricName}]++
+	m := &consumerMetrics{
+		matched:     metrics.LinesMatched.WithLabelValues(strategy.MetricName, filePath),
+		unmatched:   metrics.LinesUnmatched.WithLabelValues(strategy.MetricName, filePath),
+		contains:    metrics.LinesFiltered.WithLabelValues(strategy.MetricName, filePath, "contains"),
+		exclude:     metrics.LinesFiltered.WithLabelValues(strategy.MetricName, filePath, "exclude"),
+		panics:      metrics.AnalysisPanics.WithLabelValues(strategy.MetricName, filePath),
+		latency:     metrics.AnalysisDuration.WithLabelValues(strategy.MetricName),
+		streamDepth: metrics.StreamDepth.WithLabelValues(strategy.MetricName, filePath),
+		tagMisses:   make(map[string]prometheus.Counter),
+	}
+	for key := range strategy.Tags {
+		sharedSeries.refs[sharedKey{metricName: strategy.MetricName, tag: key}]++
+		m.tagMisses[key] = metrics.TagMisses.WithLabelValues(strategy.MetricName, key)
+	}
+	return m
+}
+
+// deleteConsumerMetrics 消费者组停止时删除该文件的运行指标, 避免glob匹配过的文件及已删除策略的series一直保留
+func deleteConsumerMetrics(filePath string, strategy *config.LogStrategy) {
+	metrics.LinesMatched.DeleteLabelValues(strategy.MetricName, filePath)
+	metrics.LinesUnmatched.DeleteLabelValues(strategy.MetricName, filePath)
+	metrics.LinesFiltered.DeleteLabelValues(strategy.MetricName, filePath, "contains")
+	metrics.LinesFiltered.DeleteLabelValues(strategy.MetricName, filePath, "exclude")
+	metrics.AnalysisPanics.DeleteLabelValues(strategy.MetricName, filePath)
+	metrics.StreamDepth.DeleteLabelValues(strategy.MetricName, filePath)
+	metrics.Consumers.DeleteLabelValues(strategy.MetricName, filePath)
+
+	sharedSeries.Lock()
+	defer sharedSeries.Unlock()
+	if release(sharedKey{metricName: strategy.MetricName}) {
+		metrics.AnalysisDuration.DeleteLabelValues(strategy.MetricName)
+	}
+	for key := range strategy.Tags {
+		if release(sharedKey{metricName: strategy.MetricName, tag: key}) {
+			metrics.TagMisses.DeleteLabelValues(strategy.MetricName, key)
+		}
+	}
+}
+
+// 减少引用计数, 返回是否为最后一个引用, 调用方需持有sharedSeries的锁
+func release(key sharedKey) bool {
+	if sharedSeries.refs[key]--; sharedSeries.refs[key] > 0 {
+		return false
+	}
+	delete(sharedSeries.refs, key)
+	return true
 }
 
 // AnalysisPoint 从Consumer 往计算部分推的point
+// 消费者在本地按series预聚合, 一个AnalysisPoint为一个series在一个批次内的部分统计值
 type AnalysisPoint struct {
-	Value           float64 // 可能是数字的正则结果, cnt 记数的时候是NaN
-	MetricsName     string  // Metrics name
-	LogFunc         string  // 计算的方法, cnt/max/min
-	SortLabelString string  // 标签排序的结果
+	MetricsName     string // Metrics name
+	LogFunc         string // 计算的方法, cnt/max/min
+	SortLabelString string // 标签排序的结果
 	LabelMap        map[string]string
+	Fingerprint     string // 产生该point的策略指纹, 策略被修改后旧策略推送的point会被丢弃
+
+	Count      int64     // 日志条数
+	ValueCount int64     // 数字结果的个数, 非数字的结果(如cnt)只参与记数
+	Sum        float64   // 数字结果的Sum
+	Max        float64   // 数字结果的Max, 没有数字结果时为NaN
+	Min        float64   // 数字结果的Min, 没有数字结果时为NaN
+	Values     []float64 // histogram/summary需要observe的每一个数字结果
+}
+
+func newAnalysisPoint(metricsName, logFunc, sortLabelString string, labelMap map[string]string, fingerprint string) *AnalysisPoint {
+	return &AnalysisPoint{
+		MetricsName:     metricsName,
+		LogFunc:         logFunc,
+		SortLabelString: sortLabelString,
+		LabelMap:        labelMap,
+		Fingerprint:     fingerprint,
+		Max:             math.NaN(),
+		Min:             math.NaN(),
+	}
+}
+
+// add 累加一行日志的结果, value为NaN时只参与记数
+func (ap *AnalysisPoint) add(value float64) {
+	ap.Count++
+	if math.IsNaN(value) {
+		return
+	}
+	ap.ValueCount++
+	ap.Sum += value
+	if math.IsNaN(ap.Max) || value > ap.Max {
+		ap.Max = value
+	}
+	if math.IsNaN(ap.Min) || value < ap.Min {
+		ap.Min = value
+	}
+	if ap.LogFunc == common.LogFuncHistogram || ap.LogFunc == common.LogFuncSummary {
+		ap.Values = append(ap.Values, value)
+	}
 }
 
 func (c *Consumer) Start() {
@@ -51,6 +178,10 @@ func (c *Consumer) Work() {
 		anaCnt, anaSwp int64
 	)
 
+	// 定期推送本地预聚合的结果
+	flushTicker := time.NewTicker(common.BatchFlushInterval)
+	defer flushTicker.Stop()
+
 	// 统计分析goroutine生命周期控制channel
 	analysisClose := make(chan struct{})
 	go func() {
@@ -72,14 +203,19 @@ func (c *Consumer) Work() {
 		case line := <-c.Stream:
 			// 处理数量自增
 			anaCnt++
+			c.metrics.streamDepth.Set(float64(len(c.Stream)))
 			// 调整日志处理中标记位
 			c.IsAnalysing = true
-			// 调用analysis方法进行日志处理
-			c.analysis(line)
+			c.consume(line, common.BatchMaxLines)
 			// 处理完毕后恢复标记位
 			c.IsAnalysing = false
 
+		case <-flushTicker.C:
+			c.flush()
+
 		case <-c.Close:
+			// 停止前推送尚未推送的结果
+			c.flush()
 			// 控制统计go routine生命周期
 			analysisClose <- struct{}{}
 			return
@@ -87,23 +223,108 @@ func (c *Consumer) Work() {
 	}
 }
 
+// consume 调用analysis方法进行日志处理, 批次内的行数达到maxLines时立即推送, 限制延迟以及histogram/summary缓存的数值个数
+func (c *Consumer) consume(line string, maxLines int) {
+	c.analysis(line)
+	if c.batchLines >= maxLines {
+		c.flush()
+	}
+}
+
 // consumer处理文本动作
 func (c *Consumer) analysis(line string) {
-	log.Printf("[Consumer:%v] analysising line %s", c.Mark, line)
-
+	start := time.Now()
 	defer func() {
 		if err := recover(); err != nil {
+			c.metrics.panics.Inc()
 			log.Printf("consumer.analysis: [analysis.panic][mark:%v][err:%v]\n", c.Mark, err)
 		}
+		c.metrics.latency.Observe(time.Since(start).Seconds())
 	}()
 
+	// 先使用代价较低的字面量及exclude正则过滤, 避免每行都执行完整的解析
+	if !c.prefilter(line) {
+		return
+	}
+
+	// 根据解析方式从日志中提取数值及标签
+	var (
+		value    float64
+		labelMap map[string]string
+		matched  bool
+	)
+	switch c.Strategy.Parser {
+	case common.ParserJSON:
+		value, labelMap, matched = c.parseJSON(line)
+	case common.ParserLogfmt:
+		value, labelMap, matched = c.parseLogfmt(line)
+	case common.ParserFormat:
+		value, labelMap, matched = c.parseFormat(line)
+	default:
+		value, labelMap, matched = c.parseRegex(line)
+	}
+	if !matched {
+		c.metrics.unmatched.Inc()
+		return
+	}
+	c.metrics.matched.Inc()
+
+	// file_path为glob或目录时, 可以将匹配到的文件路径作为标签
+	if c.Strategy.FileLabel != "" {
+		labelMap[c.Strategy.FileLabel] = c.FilePath
+	}
+
+	// 按标签组合累加到本地的AnalysisPoint中
+	sortLabelString := SortedTags(labelMap)
+	ap, ok := c.batch[sortLabelString]
+	if !ok {
+		ap = newAnalysisPoint(c.Strategy.MetricName, c.Strategy.Func, sortLabelString, labelMap, c.fingerprint)
+		c.batch[sortLabelString] = ap
+	}
+	ap.add(value)
+	c.batchLines++
+}
+
+// flush 将本地预聚合的结果推送到CounterQueue中, Counter会对该Queue进行消费进行对应计算方式(sum\max\min...)的处理
+func (c *Consumer) flush() {
+	if len(c.batch) == 0 {
+		return
+	}
+	batch := make([]*AnalysisPoint, 0, len(c.batch))
+	for _, ap := range c.batch {
+		batch = append(batch, ap)
+	}
+	c.CounterQueue <- batch
+	c.batch = make(map[string]*AnalysisPoint, len(batch))
+	c.batchLines = 0
+}
+
+// 解析之前的过滤: 必须包含全部contains字面量, 且不匹配任一exclude正则
+func (c *Consumer) prefilter(line string) bool {
+	for _, literal := range c.Strategy.Contains {
+		if !strings.Contains(line, literal) {
+			c.metrics.contains.Inc()
+			return false
+		}
+	}
+	for _, reg := range c.Strategy.ExcludeRegs {
+		if reg.MatchString(line) {
+			c.metrics.exclude.Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// 使用主正则及tags正则处理日志, 没有匹配主正则时返回false
+func (c *Consumer) parseRegex(line string) (value float64, labelMap map[string]string, matched bool) {
 	// 开始处理用户正则
 	var (
 		patternReg *regexp.Regexp
-		value      = math.NaN()
 		vString    string // 非cnt的正则 数字分组
 
 	)
+	value = math.NaN()
 	// 从消费者结构体成员获取来自配置的主正则pattern
 	patternReg = c.Strategy.PatternReg
 
@@ -116,21 +337,28 @@ func (c *Consumer) analysis(line string) {
 	*/
 	// 没匹配到,直接return
 	if len(v) == 0 {
-		return
+		return value, nil, false
 	}
 
-	// 如果全匹配到了则取第二位(小括号内容)
-	if len(v) > 1 {
-		vString = v[1]
+	// 取数值对应的分组, 默认为第二位(第一个小括号内容), 有命名分组时为value_group对应的分组
+	if idx := c.Strategy.ValueIndex; idx > 0 && len(v) > idx {
+		vString = v[idx]
 	}
 
-	// 尝试将vString转化为float,如果成功说明匹配到了200 (code=200)
-	value, _ = strconv.ParseFloat(vString, 64)
+	// 尝试将vString转化为float,如果成功说明匹配到了200 (code=200), 失败时保持NaN
+	if f, err := strconv.ParseFloat(vString, 64); err == nil {
+		value = f
+	}
 
 	// TODO analysis 如果等于1呢？
 
+	// 主正则的命名分组直接作为标签
+	labelMap = map[string]string{}
+	for key, idx := range c.Strategy.GroupLabels {
+		labelMap[key] = v[idx]
+	}
+
 	// 处理tag的正则
-	labelMap := map[string]string{}
 	// 从配置中获取到tag的Regexp
 	for key, regTag := range c.Strategy.TagRegs {
 		labelMap[key] = ""
@@ -146,19 +374,11 @@ func (c *Consumer) analysis(line string) {
 				key则为level, value为(.*?)匹配到的内容
 			*/
 			labelMap[key] = t[1]
+			continue
 		}
+		c.metrics.tagMisses[key].Inc()
 	}
-
-	// 构造AnalysisPoint
-	ret := &AnalysisPoint{
-		Value:           value,
-		MetricsName:     c.Strategy.MetricName,
-		LogFunc:         c.Strategy.Func,
-		SortLabelString: SortedTags(labelMap),
-		LabelMap:        labelMap,
-	}
-	// 将结果推送到放入到CounterQueue中, Counter会对该Queue进行消费进行对应计算方式(sum\max\min...)的处理
-	c.CounterQueue <- ret
+	return value, labelMap, true
 }
 
 // SortedTags tags排序
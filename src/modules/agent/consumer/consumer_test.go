@@ -0,0 +1,86 @@
+package consumer_test
+
+import (
+	"context"
+	"fmt"
+	"log2metrics/src/common"
+	"log2metrics/src/modules/agent/config"
+	"log2metrics/src/modules/agent/consumer"
+	"log2metrics/src/modules/agent/counter"
+	"log2metrics/src/modules/metrics"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 与nginx_log_generator相同格式的日志, 路径分布在5个服务上
+func benchmarkLines() []string {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`187.167.%d.211 - - [29/Dec/2021:22:01:14 +0800] "GET /svc%d/executive_Synchronised.php HTTP/1.1" [code=200] %d "-" "Mozilla/5.0"`,
+			i%256, i%5, 800+i)
+	}
+	return lines
+}
+
+// BenchmarkCounterQueue 消费者处理每行日志并由运行中的UpdateManager合并的总耗时(ns/op即ns/line)
+//
+//	per_line: 每行推送一个AnalysisPoint, 即批量推送之前的方式
+//	batched: 按series本地预聚合, 每BatchMaxLines行推送一批
+func BenchmarkCounterQueue(b *testing.B) {
+	b.Run("per_line", func(b *testing.B) {
+		benchmarkCounterQueue(b, 1)
+	})
+	b.Run("batched", func(b *testing.B) {
+		benchmarkCounterQueue(b, common.BatchMaxLines)
+	})
+}
+
+func benchmarkCounterQueue(b *testing.B, batchLines int) {
+	ss := config.ParseStrategies([]*config.LogStrategy{{
+		MetricName: "svc_requests",
+		FilePath:   "access.log",
+		Pattern:    `"GET /(?P<svc>\w+)/\S* HTTP/1\.1" \[code=(?P<code>\d+)\] (?P<value>\d+)`,
+		Func:       common.LogFuncCnt,
+	}}, nil)
+	if len(ss) != 1 {
+		b.Fatalf("parsed %d strategies, want 1", len(ss))
+	}
+	cq := make(chan []*consumer.AnalysisPoint, common.CounterQueueSize)
+	pcm := counter.NewPointCounterManager(cq, nil)
+	mmap := metrics.NewMetricsRegistry(prometheus.NewRegistry(), pcm).Sync(ss)
+	pcm.SetMetricsMap(mmap)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pcm.UpdateManager(ctx, runtime.NumCPU())
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	c := consumer.NewConsumerGroup(ss[0].FilePath, make(chan string), ss[0], cq).Consumers[0]
+	lines := benchmarkLines()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		consumer.Consume(c, lines[i%len(lines)], batchLines)
+	}
+	consumer.Flush(c)
+	// 等待UpdateManager合并完全部数据
+	for {
+		var total float64
+		pcm.RangeSeries(mmap[ss[0].MetricName], func(labelMap map[string]string, value float64) {
+			total += value
+		})
+		if total >= float64(b.N) {
+			break
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+	b.StopTimer()
+}
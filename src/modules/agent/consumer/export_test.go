@@ -0,0 +1,7 @@
+package consumer
+
+// 供consumer_test驱动消费者的处理流程, counter依赖consumer, 使用counter的测试只能放在外部测试包中
+var (
+	Consume = (*Consumer).consume
+	Flush   = (*Consumer).flush
+)
@@ -0,0 +1,37 @@
+package consumer
+
+import (
+	"math"
+	"strconv"
+)
+
+// 从解析后的字段中按照filters/value_field/tags取值, 用于logfmt及format等按字段名引用的解析方式
+// 不满足filters时返回false
+func (c *Consumer) selectFields(fields map[string]string) (value float64, labelMap map[string]string, matched bool) {
+	value = math.NaN()
+
+	// 字段不存在时视为不满足过滤条件
+	for _, f := range c.Strategy.FilterRules {
+		v, ok := fields[f.Field]
+		if !ok || !f.Match(v) {
+			return value, nil, false
+		}
+	}
+
+	// 数值字段, 无法转换为数字时保持NaN
+	if key := c.Strategy.ValueField; key != "" {
+		if f, err := strconv.ParseFloat(fields[key], 64); err == nil {
+			value = f
+		}
+	}
+
+	labelMap = make(map[string]string, len(c.Strategy.Tags))
+	for key, field := range c.Strategy.Tags {
+		v, ok := fields[field]
+		if !ok {
+			c.metrics.tagMisses[key].Inc()
+		}
+		labelMap[key] = v
+	}
+	return value, labelMap, true
+}
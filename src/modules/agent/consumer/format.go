@@ -0,0 +1,22 @@
+package consumer
+
+import (
+	"math"
+)
+
+// 按照format预置的格式处理日志, 预置正则的命名分组作为字段, 没有匹配或不满足filters时返回false
+func (c *Consumer) parseFormat(line string) (value float64, labelMap map[string]string, matched bool) {
+	reg := c.Strategy.PatternReg
+	v := reg.FindStringSubmatch(line)
+	if len(v) == 0 {
+		return math.NaN(), nil, false
+	}
+	// 可选字段没有出现时视为字段不存在
+	fields := make(map[string]string, len(v))
+	for i, name := range reg.SubexpNames() {
+		if name != "" && v[i] != "" {
+			fields[name] = v[i]
+		}
+	}
+	return c.selectFields(fields)
+}
@@ -5,51 +5,154 @@ import (
 	"log"
 	"log2metrics/src/common"
 	"log2metrics/src/modules/agent/config"
+	"log2metrics/src/modules/metrics"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // ConsumerGroup 定义消费者组
 type ConsumerGroup struct {
+	sync.Mutex
 	Consumers   []*Consumer
 	ConsumerNum int
+	FilePath    string
+	Strategy    *config.LogStrategy
+
+	stream      chan string
+	cq          chan []*AnalysisPoint
+	metrics     *consumerMetrics // 组内消费者共用的运行指标
+	fingerprint string           // 策略指纹, 只计算一次
+	consumers   prometheus.Gauge // 当前消费者数量
+	close       chan struct{}    // 控制autoscale goroutine生命周期
+	stopped     chan struct{}    // autoscale goroutine退出后关闭
 }
 
 func (cg *ConsumerGroup) Start() {
+	cg.Lock()
 	// 根据消费者组的结构体成员数量,生成对应数量的消费者
 	for i := 0; i < cg.ConsumerNum; i++ {
 		// 调用start方法
 		cg.Consumers[i].Start()
 	}
+	cg.consumers.Set(float64(cg.ConsumerNum))
+	cg.Unlock()
+
+	// 配置了autoscale时根据Stream积压调整消费者数量
+	if cg.Strategy.Autoscale != nil {
+		go cg.autoscale()
+	} else {
+		close(cg.stopped)
+	}
 }
 
 func (cg *ConsumerGroup) Stop() {
+	// 先停止autoscale, 避免停止过程中再增加消费者
+	close(cg.close)
+	<-cg.stopped
+
+	cg.Lock()
 	for i := 0; i < cg.ConsumerNum; i++ {
 		cg.Consumers[i].Stop()
 	}
+	cg.Unlock()
+	// 删除该文件的运行指标, 避免保留已经停止的series
+	deleteConsumerMetrics(cg.FilePath, cg.Strategy)
+}
+
+// autoscale 定期检测Stream积压占容量的比例, 每次增加或减少一个消费者
+// 积压超过scale_up时立即增加; 连续多次低于scale_down时才减少, 避免积压波动时反复增减
+func (cg *ConsumerGroup) autoscale() {
+	defer close(cg.stopped)
+	as := cg.Strategy.Autoscale
+	ticker := time.NewTicker(as.Interval)
+	defer ticker.Stop()
+	low := 0 // 连续低于scale_down的次数
+	for {
+		select {
+		case <-cg.close:
+			return
+		case <-ticker.C:
+		}
+		backlog := float64(len(cg.stream)) / float64(cap(cg.stream))
+		if backlog <= as.ScaleDown {
+			low++
+		} else {
+			low = 0
+		}
+		switch {
+		case backlog >= as.ScaleUp && cg.ConsumerNum < as.MaxConsumers:
+			cg.scaleUp()
+		case low >= common.AutoscaleScaleDownChecks && cg.ConsumerNum > cg.Strategy.Consumers:
+			low = 0
+			cg.scaleDown()
+		default:
+			continue
+		}
+		log.Printf("[ConsumerGroup.autoscale][file:%s][sid:%s][backlog:%.2f][num:%d]", cg.FilePath, cg.Strategy.MetricName, backlog, cg.ConsumerNum)
+	}
+}
+
+// scaleUp 增加一个消费者
+func (cg *ConsumerGroup) scaleUp() {
+	cg.Lock()
+	defer cg.Unlock()
+	c := cg.newConsumer(cg.ConsumerNum)
+	cg.Consumers = append(cg.Consumers, c)
+	cg.ConsumerNum++
+	cg.consumers.Set(float64(cg.ConsumerNum))
+	c.Start()
+}
+
+// scaleDown 停止最后一个消费者, 它正在处理的行会处理完毕, Stream中剩余的行由其余消费者处理
+func (cg *ConsumerGroup) scaleDown() {
+	cg.Lock()
+	defer cg.Unlock()
+	cg.ConsumerNum--
+	cg.Consumers[cg.ConsumerNum].Stop()
+	cg.Consumers = cg.Consumers[:cg.ConsumerNum]
+	cg.consumers.Set(float64(cg.ConsumerNum))
+}
+
+func (cg *ConsumerGroup) newConsumer(i int) *Consumer {
+	mark := fmt.Sprintf("[log.consumer][file:%s][num:%d]", cg.FilePath, i+1)
+	return &Consumer{
+		FilePath:     cg.FilePath,
+		Stream:       cg.stream,
+		Strategy:     cg.Strategy,
+		Mark:         mark,
+		Close:        make(chan struct{}),
+		IsAnalysing:  false,
+		CounterQueue: cg.cq,
+		metrics:      cg.metrics,
+		fingerprint:  cg.fingerprint,
+		batch:        make(map[string]*AnalysisPoint),
+	}
 }
 
-func NewConsumerGroup(filePath string, stream chan string, strategy *config.LogStrategy, cq chan *AnalysisPoint) *ConsumerGroup {
+func NewConsumerGroup(filePath string, stream chan string, strategy *config.LogStrategy, cq chan []*AnalysisPoint) *ConsumerGroup {
 
 	cg := &ConsumerGroup{
 		Consumers:   make([]*Consumer, 0),
-		ConsumerNum: common.ConsumerNumber,
+		ConsumerNum: strategy.Consumers,
+		FilePath:    filePath,
+		Strategy:    strategy,
+		stream:      stream,
+		cq:          cq,
+		metrics:     newConsumerMetrics(filePath, strategy),
+		fingerprint: strategy.Fingerprint(),
+		consumers:   metrics.Consumers.WithLabelValues(strategy.MetricName, filePath),
+		close:       make(chan struct{}),
+		stopped:     make(chan struct{}),
 	}
 
-	log.Printf("[new ConsumerGroup][file:%s][num:%d]", filePath, common.ConsumerNumber)
+	log.Printf("[new ConsumerGroup][file:%s][num:%d]", filePath, cg.ConsumerNum)
 
 	// 根据消费组成员数量决定Consumer数量,并生成对应consumer
-	for i := 0; i < common.ConsumerNumber; i++ {
-		mark := fmt.Sprintf("[log.consumer][file:%s][num:%d/%d]", filePath, i+1, common.ConsumerNumber)
-		c := &Consumer{
-			FilePath:     filePath,
-			Stream:       stream,
-			Strategy:     strategy,
-			Mark:         mark,
-			Close:        make(chan struct{}),
-			IsAnalysing:  false,
-			CounterQueue: cq,
-		}
+	for i := 0; i < cg.ConsumerNum; i++ {
 		// append消费者
-		cg.Consumers = append(cg.Consumers, c)
+		cg.Consumers = append(cg.Consumers, cg.newConsumer(i))
 	}
 	return cg
 }
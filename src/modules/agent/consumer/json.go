@@ -0,0 +1,51 @@
+package consumer
+
+import (
+	"encoding/json"
+	"log2metrics/src/modules/agent/config"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 按照json路径处理json格式的日志, 不是合法json或不满足filters时返回false
+func (c *Consumer) parseJSON(line string) (value float64, labelMap map[string]string, matched bool) {
+	value = math.NaN()
+
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(line))
+	// 保留数字的原始格式, 避免较大的整数作为标签时变成科学计数法
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return value, nil, false
+	}
+
+	// 字段不存在时视为不满足过滤条件
+	for _, f := range c.Strategy.FilterRules {
+		v, ok := f.Path.Get(doc)
+		if !ok || !f.Match(config.JSONString(v)) {
+			return value, nil, false
+		}
+	}
+
+	// 数值字段, 无法转换为数字时保持NaN
+	if c.Strategy.ValuePath != nil {
+		if v, ok := c.Strategy.ValuePath.Get(doc); ok {
+			if f, err := strconv.ParseFloat(config.JSONString(v), 64); err == nil {
+				value = f
+			}
+		}
+	}
+
+	labelMap = make(map[string]string, len(c.Strategy.TagPaths))
+	for key, p := range c.Strategy.TagPaths {
+		v, ok := p.Get(doc)
+		if !ok {
+			labelMap[key] = ""
+			c.metrics.tagMisses[key].Inc()
+			continue
+		}
+		labelMap[key] = config.JSONString(v)
+	}
+	return value, labelMap, true
+}
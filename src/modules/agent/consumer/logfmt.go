@@ -0,0 +1,75 @@
+package consumer
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 按照key处理logfmt格式的日志, 不包含任何key=value或不满足filters时返回false
+func (c *Consumer) parseLogfmt(line string) (value float64, labelMap map[string]string, matched bool) {
+	fields, pairs := parseLogfmtFields(line)
+	// 只有单独的单词(如普通文本日志)时不视为logfmt
+	if pairs == 0 {
+		return math.NaN(), nil, false
+	}
+	return c.selectFields(fields)
+}
+
+// 解析logfmt格式的key=value, value可以使用双引号包含空格及转义字符, 只有key时value为空
+// pairs为其中key=value的个数
+func parseLogfmtFields(line string) (fields map[string]string, pairs int) {
+	fields = make(map[string]string)
+	s := line
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return fields, pairs
+		}
+		// key到=或空白为止
+		end := strings.IndexAny(s, "= \t")
+		if end < 0 {
+			fields[s] = ""
+			return fields, pairs
+		}
+		key := s[:end]
+		if s[end] != '=' {
+			if key != "" {
+				fields[key] = ""
+			}
+			s = s[end:]
+			continue
+		}
+		s = s[end+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			val, s = readLogfmtQuoted(s)
+		} else {
+			end = strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			val, s = s[:end], s[end:]
+		}
+		if key != "" {
+			fields[key] = val
+			pairs++
+		}
+	}
+}
+
+// 读取双引号包含的value, 返回去掉引号及转义后的值与剩余内容, 引号未闭合时取到行尾
+func readLogfmtQuoted(s string) (string, string) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			if v, err := strconv.Unquote(s[:i+1]); err == nil {
+				return v, s[i+1:]
+			}
+			return s[1:i], s[i+1:]
+		}
+	}
+	return s[1:], ""
+}
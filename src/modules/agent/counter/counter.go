@@ -4,7 +4,9 @@ import (
 	"context"
 	"log"
 	"log2metrics/src/common"
+	"log2metrics/src/modules/agent/config"
 	"log2metrics/src/modules/agent/consumer"
+	"log2metrics/src/modules/metrics"
 	"math"
 	"sync"
 	"time"
@@ -13,22 +15,40 @@ import (
 )
 
 type PointCounterManager struct {
-	sync.RWMutex
-	CounterQueue chan *consumer.AnalysisPoint
-	// key是标签排序后的string
-	TagStringMap map[string]*PointCounter
-	MetricsMap   map[string]*prometheus.GaugeVec
+	CounterQueue chan []*consumer.AnalysisPoint
+	// series按metricsName+sortLabelString的hash分片存储
+	shards []*seriesShard
+	// 按指标索引的series, key为*metrics.StrategyMetric, value为seriesId到PointCounter的sync.Map, 抓取时使用
+	byMetric sync.Map
+	// 热加载时整体替换, 替换后的map不再修改
+	metricsMtx sync.RWMutex
+	MetricsMap map[string]*metrics.StrategyMetric
+	// 每个metric的series数量以及series总数, 用于max_series限制
+	cntMtx    sync.Mutex
+	seriesCnt map[string]int
+	series    int
+	// 全部metric的series总数上限, 为0时不限制
+	maxSeries int
 }
 
 // PointCounter 统计实体 与AnalysisPoint有关系
 type PointCounter struct {
 	sync.RWMutex
-	Count int64   // 日志条数记数
-	Sum   float64 // 正则数字的Sum
-	Max   float64 // 正则数字的Max
-	Min   float64 // 正则数字的Min
-	Avg   float64 // 正则数字的Avg
-	Ts    int64
+	Count      int64   // 日志条数记数
+	ValueCount int64   // 数字结果的个数, avg以此为分母, 非数字的结果只计入Count
+	Sum        float64 // 正则数字的Sum
+	Max        float64 // 正则数字的Max
+	Min        float64 // 正则数字的Min
+	Ts         int64
+
+	// histogram/summary对应标签的Observer, 每次Update时直接observe
+	Observer prometheus.Observer
+	// max/min/avg的统计窗口, 为nil时统计全部数据
+	window *window
+	// 构造时对应的指标, 热加载重建指标后该PointCounter失效
+	metric *metrics.StrategyMetric
+	// 已经从PointCounterManager中删除, 之后的Update不再合并数据
+	dead bool
 
 	MetricsName     string // Metrics name
 	LogFunc         string // 计算的方法, cnt/max/min
@@ -38,6 +58,9 @@ type PointCounter struct {
 
 func NewPointCounter(metricsName string, sortLabelString string, logFunc string, labelMap map[string]string) *PointCounter {
 	return &PointCounter{
+		Max:             math.NaN(),
+		Min:             math.NaN(),
+		Ts:              time.Now().Unix(), // 构造时即视为更新, 避免第一次Update之前被当作过期series删除
 		MetricsName:     metricsName,
 		LogFunc:         logFunc,
 		SortLabelString: sortLabelString,
@@ -45,125 +68,389 @@ func NewPointCounter(metricsName string, sortLabelString string, logFunc string,
 	}
 }
 
-// Update 更新PointCounter的值
-func (pc *PointCounter) Update(value float64) {
+// SetWindow 根据策略的window配置max/min/avg的统计窗口
+func (pc *PointCounter) SetWindow(s *config.LogStrategy) {
+	if s.Window <= 0 {
+		return
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	pc.window = newWindow(s.Window, s.WindowType == common.WindowSliding, common.WindowSlots)
+}
+
+// Update 将消费者预聚合的部分统计值合并到PointCounter中
+// PointCounter已经被删除时返回false, 由调用方重新查找或构造
+func (pc *PointCounter) Update(ap *consumer.AnalysisPoint) bool {
 	pc.Lock()
 	defer pc.Unlock()
+	if pc.dead {
+		return false
+	}
+	now := time.Now()
+	pc.Count += ap.Count
+	pc.Ts = now.Unix()
+
+	// 非数字的正则结果只参与记数
+	if ap.ValueCount == 0 {
+		return true
+	}
+
 	// 计算sum
-	pc.Sum = pc.Sum + value
+	pc.ValueCount += ap.ValueCount
+	pc.Sum = pc.Sum + ap.Sum
+	if pc.window != nil {
+		pc.window.merge(now, ap.ValueCount, ap.Sum, ap.Max, ap.Min)
+	}
 
 	// 更新最大值
-	if math.IsNaN(pc.Max) || value > pc.Max {
-		pc.Max = value
+	if math.IsNaN(pc.Max) || ap.Max > pc.Max {
+		pc.Max = ap.Max
 	}
 	// 更新最小值
-	if math.IsNaN(pc.Min) || value < pc.Min {
-		pc.Min = value
+	if math.IsNaN(pc.Min) || ap.Min < pc.Min {
+		pc.Min = ap.Min
 	}
-	pc.Count++
 
-	pc.Ts = time.Now().Unix()
+	// histogram/summary直接observe每一个值
+	if pc.Observer != nil {
+		for _, value := range ap.Values {
+			pc.Observer.Observe(value)
+		}
+	}
+	return true
+}
+
+// kill 标记PointCounter已经被删除, 调用方需持有分片锁
+func (pc *PointCounter) kill() {
+	pc.Lock()
+	defer pc.Unlock()
+	pc.dead = true
+}
+
+// killExpired 超过ttl没有更新时标记PointCounter已经被删除, 检查与标记在同一次加锁内完成, 期间合并的数据不会丢失
+// 调用方需持有分片锁
+func (pc *PointCounter) killExpired(now time.Time, ttl time.Duration) bool {
+	pc.Lock()
+	defer pc.Unlock()
+	if ttl <= 0 || now.Sub(time.Unix(pc.Ts, 0)) <= ttl {
+		return false
+	}
+	pc.dead = true
+	return true
 }
 
-func NewPointCounterManager(cq chan *consumer.AnalysisPoint, metricsMap map[string]*prometheus.GaugeVec) *PointCounterManager {
+// Expired 判断PointCounter是否超过ttl没有更新
+func (pc *PointCounter) Expired(now time.Time, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	pc.RLock()
+	defer pc.RUnlock()
+	return now.Sub(time.Unix(pc.Ts, 0)) > ttl
+}
+
+// Value 根据计算方式获取PointCounter当前的值
+func (pc *PointCounter) Value() float64 {
+	pc.RLock()
+	defer pc.RUnlock()
+	// 配置了统计窗口时, max/min/avg只统计窗口内的数据
+	if pc.window != nil {
+		max, min, avg := pc.window.aggregate(time.Now())
+		switch pc.LogFunc {
+		case common.LogFuncMax:
+			return max
+		case common.LogFuncMin:
+			return min
+		case common.LogFuncAvg:
+			return avg
+		}
+	}
+	switch pc.LogFunc {
+	case common.LogFuncCnt:
+		return float64(pc.Count)
+	case common.LogFuncSum:
+		return pc.Sum
+	case common.LogFuncMax:
+		return pc.Max
+	case common.LogFuncMin:
+		return pc.Min
+	case common.LogFuncAvg:
+		// 与统计窗口一致, 只对数字结果求平均
+		if pc.ValueCount == 0 {
+			return math.NaN()
+		}
+		return pc.Sum / float64(pc.ValueCount)
+	}
+	return math.NaN()
+}
+
+func NewPointCounterManager(cq chan []*consumer.AnalysisPoint, metricsMap map[string]*metrics.StrategyMetric) *PointCounterManager {
 	return &PointCounterManager{
 		CounterQueue: cq,
-		TagStringMap: make(map[string]*PointCounter),
+		shards:       newShards(common.SeriesShards),
 		MetricsMap:   metricsMap,
+		seriesCnt:    make(map[string]int),
+	}
+}
+
+// SetMaxSeries 设置全部metric的series总数上限
+func (pcm *PointCounterManager) SetMaxSeries(maxSeries int) {
+	pcm.cntMtx.Lock()
+	defer pcm.cntMtx.Unlock()
+	pcm.maxSeries = maxSeries
+}
+
+// SetMetricsMap 配置热加载后替换MetricsMap, 并清理指标已被重建或删除的metric对应的PointCounter
+func (pcm *PointCounterManager) SetMetricsMap(metricsMap map[string]*metrics.StrategyMetric) {
+	pcm.metricsMtx.Lock()
+	pcm.MetricsMap = metricsMap
+	pcm.metricsMtx.Unlock()
+	for _, e := range pcm.snapshot() {
+		if metricsMap[e.pc.MetricsName] != e.pc.metric {
+			pcm.deleteStale(e)
+		}
+	}
+	pcm.pruneIndex(metricsMap)
+}
+
+// 删除指标已被重建或删除的PointCounter
+func (pcm *PointCounterManager) deleteStale(e seriesEntry) {
+	s := pcm.shard(e.seriesId)
+	s.Lock()
+	defer s.Unlock()
+	if s.load(e.seriesId) == e.pc {
+		e.pc.kill()
+		pcm.deletePc(s, e.seriesId, e.pc)
 	}
 }
 
-// SetPc Set 更新实体方法
-func (pcm *PointCounterManager) SetPc(seriesId string, pc *PointCounter) {
-	pcm.Lock()
-	defer pcm.Unlock()
-	pcm.TagStringMap[seriesId] = pc
+func (pcm *PointCounterManager) metricsMap() map[string]*metrics.StrategyMetric {
+	pcm.metricsMtx.RLock()
+	defer pcm.metricsMtx.RUnlock()
+	return pcm.MetricsMap
 }
 
-// GetPcByUniqueName 获取实体方法
-func (pcm *PointCounterManager) GetPcByUniqueName(seriesId string) *PointCounter {
-	pcm.RLock()
-	defer pcm.RUnlock()
-	return pcm.TagStringMap[seriesId]
+// reserveSeries 为新的标签组合预留series数量, limit为true且已经达到策略或全局的max_series限制时返回false
+// 检查与计数在同一次加锁内完成, 不同分片的worker同时新增series时也不会超过限制
+func (pcm *PointCounterManager) reserveSeries(s *config.LogStrategy, limit bool) bool {
+	pcm.cntMtx.Lock()
+	defer pcm.cntMtx.Unlock()
+	if limit {
+		if s.MaxSeries > 0 && pcm.seriesCnt[s.MetricName] >= s.MaxSeries {
+			return false
+		}
+		if pcm.maxSeries > 0 && pcm.series >= pcm.maxSeries {
+			return false
+		}
+	}
+	pcm.seriesCnt[s.MetricName]++
+	pcm.series++
+	return true
+}
+
+// 归还预留但没有保存PointCounter的series数量
+func (pcm *PointCounterManager) releaseSeries(metricsName string) {
+	pcm.cntMtx.Lock()
+	defer pcm.cntMtx.Unlock()
+	pcm.series--
+	pcm.decSeries(metricsName)
+}
+
+// 将超过series限制的AnalysisPoint的标签合并为__overflow__, 文件标签保持不变
+func overflowPoint(ap *consumer.AnalysisPoint, s *config.LogStrategy) *consumer.AnalysisPoint {
+	labelMap := make(map[string]string, len(ap.LabelMap))
+	for k, v := range ap.LabelMap {
+		if k != s.FileLabel {
+			v = common.SeriesOverflowValue
+		}
+		labelMap[k] = v
+	}
+	op := *ap
+	op.SortLabelString = consumer.SortedTags(labelMap)
+	op.LabelMap = labelMap
+	return &op
+}
+
+// 获取AnalysisPoint对应的PointCounter以及指标, metric已经不存在时指标为nil
+func (pcm *PointCounterManager) getPc(ap *consumer.AnalysisPoint) (*PointCounter, *metrics.StrategyMetric) {
+	metric, loaded := pcm.metricsMap()[ap.MetricsName]
+	if !loaded {
+		return nil, nil
+	}
+	return pcm.GetPcByUniqueName(ap.MetricsName + ap.SortLabelString), metric
 }
 
-func (pcm *PointCounterManager) UpdateManager(ctx context.Context) error {
+// UpdateManager 启动workers个goroutine消费CounterQueue, series按分片加锁, 多个worker可以并行更新
+func (pcm *PointCounterManager) UpdateManager(ctx context.Context, workers int) error {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pcm.updateWorker(ctx)
+		}()
+	}
+	wg.Wait()
+	log.Println("PointCounterManager.UpdateManager.receive_quit_signal_and_quit")
+	return nil
+}
+
+func (pcm *PointCounterManager) updateWorker(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("PointCounterManager.UpdateManager.receive_quit_signal_and_quit")
+			return
+			// 从CounterQueue接收来自于consumer批量推送的AnalysisPoint进行处理
+		case batch := <-pcm.CounterQueue:
+			for _, ap := range batch {
+				pcm.update(ap)
+			}
+		}
+	}
+}
+
+// update 将一个AnalysisPoint合并到对应的PointCounter中
+func (pcm *PointCounterManager) update(ap *consumer.AnalysisPoint) {
+	/*
+		尝试根据metricsName + sortLabelString
+		获取PointCounter(每个metricsName+SortLabelString会生成一个对应的统计实体,来表示该实体各种func对应的值
+		如Max\Min\Avg
+	*/
+	pc, metric := pcm.getPc(ap)
+	// 热加载后已经被删除的metric, 或者策略被修改前的消费者停止时推送的point, 直接丢弃
+	if metric == nil || !metric.Owns(ap.Fingerprint) {
+		return
+	}
+	// 如果为空则设置对应实体的PointCounter
+	// 指标不一致说明是策略修改前遗留的PointCounter, 同样重新构造
+	if pc == nil || pc.metric != metric {
+		if pc = pcm.loadOrCreate(ap, metric, true); pc == nil {
+			return
+		}
+	}
+	// 不为空, 那么说明PointCounter存在,直接更新它的值
+	// 查找时没有持有分片锁, 期间被过期清理删除时重新查找或构造
+	for !pc.Update(ap) {
+		if pc = pcm.loadOrCreate(ap, metric, true); pc == nil {
+			return
+		}
+	}
+}
+
+// loadOrCreate 在分片锁内再次查找PointCounter, 不存在时构造, 多个worker同时遇到新的标签组合时只会构造一次
+// limit为true时新的标签组合受max_series限制, 超过时合并到__overflow__或直接丢弃(返回nil)
+func (pcm *PointCounterManager) loadOrCreate(ap *consumer.AnalysisPoint, metric *metrics.StrategyMetric, limit bool) *PointCounter {
+	seriesId := ap.MetricsName + ap.SortLabelString
+	s := pcm.shard(seriesId)
+	s.Lock()
+	old := s.load(seriesId)
+	if old != nil && old.metric == metric {
+		s.Unlock()
+		return old
+	}
+	// 新的标签组合先预留series数量, 超过max_series限制时合并到__overflow__或直接丢弃
+	// __overflow__本身不受限制, 保证超限的数据仍然能被统计
+	if old == nil && !pcm.reserveSeries(metric.Strategy, limit) {
+		s.Unlock()
+		metrics.SeriesRejected.WithLabelValues(ap.MetricsName, metric.Strategy.SeriesOverflow).Inc()
+		if metric.Strategy.SeriesOverflow == common.SeriesOverflowDrop {
 			return nil
-			// 从CounterQueue接收来自于consumer推送的AnalysisPoint进行处理
-		case ap := <-pcm.CounterQueue:
-			log.Printf("PointCounterManager.UpdateManager: received ap name %s", ap.MetricsName)
-			/*
-				尝试根据metricsName + sortLabelString
-				获取PointCounter(每个metricsName+SortLabelString会生成一个对应的统计实体,来表示该实体各种func对应的值
-				如Max\Min\Avg
-			*/
-			pc := pcm.GetPcByUniqueName(ap.MetricsName + ap.SortLabelString)
-			// 如果为空则设置对应实体的PointCounter
-			if pc == nil {
-				// 构造PointCounter
-				pc = NewPointCounter(ap.MetricsName, ap.SortLabelString, ap.LogFunc, ap.LabelMap)
-				// 设置PointCounter到PointCounterManager中(以MetricsName+SortLabelString为key, value为PointCouter)
-				pcm.SetPc(ap.MetricsName+ap.SortLabelString, pc)
+		}
+		return pcm.loadOrCreate(overflowPoint(ap, metric.Strategy), metric, false)
+	}
+	defer s.Unlock()
+	// 构造PointCounter
+	pc := NewPointCounter(ap.MetricsName, ap.SortLabelString, ap.LogFunc, ap.LabelMap)
+	pc.SetWindow(metric.Strategy)
+	pc.metric = metric
+	// histogram/summary需要observe每一个值, 绑定对应标签的Observer
+	// 绑定失败(如标签与指标不一致)时不保存PointCounter, 避免该series永远无法observe
+	if vec, ok := metric.Collector.(prometheus.ObserverVec); ok {
+		observer, err := vec.GetMetricWith(ap.LabelMap)
+		if err != nil {
+			log.Printf("[PointCounterManager.UpdateManager: get observer failed][name:%v][err:%v]", ap.MetricsName, err)
+			if old == nil {
+				pcm.releaseSeries(ap.MetricsName)
 			}
-			// 不为空, 那么说明PointCounter存在,直接更新它的值
-			pc.Update(ap.Value)
+			return nil
 		}
+		pc.Observer = observer
+	}
+	// 设置PointCounter到PointCounterManager中(以MetricsName+SortLabelString为key, value为PointCouter)
+	// 新的标签组合已经预留了series数量, 替换旧指标遗留的PointCounter时数量不变
+	if old == nil {
+		pcm.insertPc(s, seriesId, pc)
+	} else {
+		pcm.replacePc(s, seriesId, old, pc)
 	}
+	return pc
 }
 
-func (pcm *PointCounterManager) SetMetrics() {
-	// 获取锁
-	pcm.Lock()
-	defer pcm.Unlock()
+// ExpireSeries 清理过期以及热加载后失效的series, 并统计每个metric的series数量
+// 指标的值在抓取时直接从PointCounter计算, 这里只负责回收不再需要的PointCounter
+func (pcm *PointCounterManager) ExpireSeries() {
+	metricsMap := pcm.metricsMap()
+
+	// 统计每个metric的series数量
+	seriesCnt := make(map[string]int)
+	defer func() {
+		metrics.ActiveSeries.Reset()
+		for name, cnt := range seriesCnt {
+			metrics.ActiveSeries.WithLabelValues(name).Set(float64(cnt))
+		}
+	}()
 
-	// 从TagStringMap获取PointCounter(key为metricsName+sortLabelString)
-	for _, pc := range pcm.TagStringMap {
-		pc := pc
-		// 如果不存在对应的PointCounter,则continue
-		metric, loaded := pcm.MetricsMap[pc.MetricsName]
+	now := time.Now()
+	for _, e := range pcm.snapshot() {
+		pc := e.pc
+		// 如果不存在对应的指标, 或者是热加载期间使用旧指标构造的PointCounter, 则删除后continue
+		metric, loaded := metricsMap[pc.MetricsName]
 		if !loaded {
 			log.Printf("[metrics.notfound[name:%v]", pc.MetricsName)
+		}
+		if !loaded || metric != pc.metric {
+			pcm.deleteStale(e)
 			continue
 		}
-		// 如果存在
-		log.Printf("[PointCounterManager.SetMetrics][pc: %+v]", pc)
-		var value float64
-
-		// 那么会根据PointCounter所需要的计算类型,进行赋值
-		switch pc.LogFunc {
-		case common.LogFuncCnt:
-			value = float64(pc.Count)
-		case common.LogFuncSum:
-			value = pc.Sum
-		case common.LogFuncMax:
-			value = pc.Max
-		case common.LogFuncMin:
-			value = pc.Min
-		case common.LogFuncAvg:
-			value = pc.Sum / float64(pc.Count)
+		// 超过series_ttl没有更新的series, 删除PointCounter以及histogram/summary中对应的child
+		if pc.Expired(now, metric.Strategy.SeriesTTL) && pcm.expire(e.seriesId, pc, metric, now) {
+			continue
 		}
-		// 并以pc.labelMap为label为label, value为对应function的value进行更新
-		metric.With(pc.LabelMap).Set(value)
+		seriesCnt[pc.MetricsName]++
+	}
+	pcm.pruneIndex(metricsMap)
+}
+
+// 删除过期的series, 在分片锁内再次确认, 期间被更新或替换的series不删除
+func (pcm *PointCounterManager) expire(seriesId string, pc *PointCounter, metric *metrics.StrategyMetric, now time.Time) bool {
+	s := pcm.shard(seriesId)
+	s.Lock()
+	defer s.Unlock()
+	if s.load(seriesId) != pc || !pc.killExpired(now, metric.Strategy.SeriesTTL) {
+		return false
+	}
+	pcm.deletePc(s, seriesId, pc)
+	// HistogramVec/SummaryVec保存了observe的结果, 需要按标签删除child
+	if vec, ok := metric.Collector.(interface {
+		Delete(prometheus.Labels) bool
+	}); ok {
+		vec.Delete(pc.LabelMap)
 	}
+	log.Printf("[PointCounterManager.ExpireSeries: series expired][name:%v][labels:%v]", pc.MetricsName, pc.SortLabelString)
+	return true
 }
 
-// SetMetricsManager 更新set metrics
-func (pcm *PointCounterManager) SetMetricsManager(ctx context.Context) error {
-	// 由ticker事件驱动的metrics更新
-	ticker := time.NewTicker(10 * time.Second)
+// ExpireManager 定期清理过期的series, interval为清理间隔
+func (pcm *PointCounterManager) ExpireManager(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("PointCounterManager.SetMetricsManager.receive_quit_signal_and_quit")
+			log.Println("PointCounterManager.ExpireManager.receive_quit_signal_and_quit")
 			return nil
 		case <-ticker.C:
-			// 调用SetMetrics方法
-			pcm.SetMetrics()
+			pcm.ExpireSeries()
 		}
 	}
 }
@@ -0,0 +1,172 @@
+package counter
+
+import (
+	"fmt"
+	"log2metrics/src/common"
+	"log2metrics/src/modules/agent/config"
+	"log2metrics/src/modules/agent/consumer"
+	"log2metrics/src/modules/metrics"
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 与agent一样解析策略并注册指标后构造PointCounterManager
+func newTestManager(tb testing.TB, st *config.LogStrategy) (*PointCounterManager, *config.LogStrategy) {
+	tb.Helper()
+	ss := config.ParseStrategies([]*config.LogStrategy{st}, nil)
+	if len(ss) != 1 {
+		tb.Fatalf("parse strategy %s failed", st.MetricName)
+	}
+	pcm := NewPointCounterManager(make(chan []*consumer.AnalysisPoint, 1024), nil)
+	pcm.SetMetricsMap(metrics.NewMetricsRegistry(prometheus.NewRegistry(), pcm).Sync(ss))
+	return pcm, ss[0]
+}
+
+// 策略的一行日志对应的AnalysisPoint, path为标签值
+func testPoint(st *config.LogStrategy, path string, value float64) *consumer.AnalysisPoint {
+	labelMap := map[string]string{"path": path}
+	ap := &consumer.AnalysisPoint{
+		MetricsName:     st.MetricName,
+		LogFunc:         st.Func,
+		SortLabelString: consumer.SortedTags(labelMap),
+		LabelMap:        labelMap,
+		Fingerprint:     st.Fingerprint(),
+		Count:           1,
+		Max:             math.NaN(),
+		Min:             math.NaN(),
+	}
+	if !math.IsNaN(value) {
+		ap.ValueCount, ap.Sum, ap.Max, ap.Min = 1, value, value, value
+	}
+	return ap
+}
+
+func (pcm *PointCounterManager) seriesCount(metricsName string) (int, int) {
+	pcm.cntMtx.Lock()
+	defer pcm.cntMtx.Unlock()
+	return pcm.seriesCnt[metricsName], pcm.series
+}
+
+// 多个worker同时新增不同分片的series时, series数量不能超过max_series
+func TestMaxSeriesConcurrent(t *testing.T) {
+	// 单核环境下goroutine很少在检查与保存之间被切换, 提高并行度以暴露竞争
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	for round := 0; round < 20; round++ {
+		pcm, st := newTestManager(t, &config.LogStrategy{
+			MetricName:     "path_cnt",
+			FilePath:       "access.log",
+			Pattern:        `GET (?P<path>\S+)`,
+			Func:           common.LogFuncCnt,
+			MaxSeries:      10,
+			SeriesOverflow: common.SeriesOverflowDrop,
+		})
+		var wg sync.WaitGroup
+		for w := 0; w < 16; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					pcm.update(testPoint(st, fmt.Sprintf("/p%d_%d", w, i), math.NaN()))
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		cnt, total := pcm.seriesCount(st.MetricName)
+		if cnt != 10 || total != 10 {
+			t.Fatalf("round %d: series count %d (total %d), want 10", round, cnt, total)
+		}
+		stored := 0
+		for _, e := range pcm.snapshot() {
+			if e.pc.MetricsName == st.MetricName {
+				stored++
+			}
+		}
+		if stored != 10 {
+			t.Fatalf("round %d: stored %d series, want 10", round, stored)
+		}
+	}
+}
+
+// 绑定Observer失败时不保存PointCounter, 预留的series数量也要归还
+func TestObserverBindFailureReleasesSeries(t *testing.T) {
+	pcm, st := newTestManager(t, &config.LogStrategy{
+		MetricName: "path_cost",
+		FilePath:   "access.log",
+		Pattern:    `GET (?P<path>\S+) (?P<value>\d+)`,
+		Func:       common.LogFuncHistogram,
+		MaxSeries:  1,
+	})
+	ap := testPoint(st, "/a", 1)
+	// 标签与指标不一致
+	ap.LabelMap = map[string]string{"path": "/a", "code": "200"}
+	ap.SortLabelString = consumer.SortedTags(ap.LabelMap)
+	pcm.update(ap)
+	if cnt, total := pcm.seriesCount(st.MetricName); cnt != 0 || total != 0 {
+		t.Fatalf("series count %d (total %d) after bind failure, want 0", cnt, total)
+	}
+
+	pcm.update(testPoint(st, "/b", 1))
+	pc := pcm.GetPcByUniqueName(st.MetricName + consumer.SortedTags(map[string]string{"path": "/b"}))
+	if pc == nil || pc.Count != 1 {
+		t.Fatalf("series /b was not stored after bind failure released the slot")
+	}
+}
+
+// 过期清理与更新同时进行时, 合并到被删除的PointCounter中的数据不能丢失
+func TestExpireConcurrentUpdate(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	pcm, st := newTestManager(t, &config.LogStrategy{
+		MetricName: "path_cnt",
+		FilePath:   "access.log",
+		Pattern:    `GET (?P<path>\S+)`,
+		Func:       common.LogFuncCnt,
+		SeriesTTL:  time.Second,
+	})
+	metric := pcm.metricsMap()[st.MetricName]
+	const workers, lines = 8, 2000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				pcm.update(testPoint(st, "/a", math.NaN()))
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// 以未来的时间清理, 每次都会删除当前的series, 被删除的PointCounter不再合并数据
+	var expired int64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, e := range pcm.snapshot() {
+			if pcm.expire(e.seriesId, e.pc, metric, time.Now().Add(time.Hour)) {
+				e.pc.RLock()
+				expired += e.pc.Count
+				e.pc.RUnlock()
+			}
+		}
+	}
+	var stored int64
+	for _, e := range pcm.snapshot() {
+		stored += e.pc.Count
+	}
+	if expired+stored != workers*lines {
+		t.Fatalf("expired %d + stored %d lines, want %d", expired, stored, workers*lines)
+	}
+}
@@ -0,0 +1,136 @@
+package counter
+
+import (
+	"log2metrics/src/modules/metrics"
+	"sync"
+	"time"
+)
+
+// seriesShard 按metricsName+sortLabelString的hash划分的series分片
+// 查找已有的series不加锁, 新增/删除series时持有分片锁, 不同分片之间互不影响
+type seriesShard struct {
+	sync.Mutex
+	series sync.Map // key为metricsName+sortLabelString, value为*PointCounter
+}
+
+// seriesEntry 导出时的series快照
+type seriesEntry struct {
+	seriesId string
+	pc       *PointCounter
+}
+
+func newShards(n int) []*seriesShard {
+	shards := make([]*seriesShard, n)
+	for i := range shards {
+		shards[i] = &seriesShard{}
+	}
+	return shards
+}
+
+// shard 获取series所在的分片, 使用FNV-1a hash
+func (pcm *PointCounterManager) shard(seriesId string) *seriesShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(seriesId); i++ {
+		h ^= uint32(seriesId[i])
+		h *= 16777619
+	}
+	return pcm.shards[h%uint32(len(pcm.shards))]
+}
+
+func (s *seriesShard) load(seriesId string) *PointCounter {
+	if v, ok := s.series.Load(seriesId); ok {
+		return v.(*PointCounter)
+	}
+	return nil
+}
+
+// GetPcByUniqueName 获取实体方法
+func (pcm *PointCounterManager) GetPcByUniqueName(seriesId string) *PointCounter {
+	return pcm.shard(seriesId).load(seriesId)
+}
+
+// 替换旧指标遗留的PointCounter并更新series数量以及按指标的索引, 被替换的PointCounter标记为已删除, 调用方需持有分片锁
+func (pcm *PointCounterManager) replacePc(s *seriesShard, seriesId string, old, pc *PointCounter) {
+	old.kill()
+	pcm.unindex(seriesId, old)
+	if old.MetricsName != pc.MetricsName {
+		pcm.cntMtx.Lock()
+		pcm.decSeries(old.MetricsName)
+		pcm.seriesCnt[pc.MetricsName]++
+		pcm.cntMtx.Unlock()
+	}
+	pcm.insertPc(s, seriesId, pc)
+}
+
+// 保存新的PointCounter, series数量已经通过reserveSeries预留, 调用方需持有分片锁
+func (pcm *PointCounterManager) insertPc(s *seriesShard, seriesId string, pc *PointCounter) {
+	if pc.metric != nil {
+		v, _ := pcm.byMetric.LoadOrStore(pc.metric, &sync.Map{})
+		v.(*sync.Map).Store(seriesId, pc)
+	}
+	s.series.Store(seriesId, pc)
+}
+
+// 删除PointCounter, 调用方需持有分片锁
+func (pcm *PointCounterManager) deletePc(s *seriesShard, seriesId string, pc *PointCounter) {
+	s.series.Delete(seriesId)
+	pcm.unindex(seriesId, pc)
+	pcm.cntMtx.Lock()
+	defer pcm.cntMtx.Unlock()
+	pcm.series--
+	pcm.decSeries(pc.MetricsName)
+}
+
+// 从按指标的索引中删除
+func (pcm *PointCounterManager) unindex(seriesId string, pc *PointCounter) {
+	if v, ok := pcm.byMetric.Load(pc.metric); ok {
+		v.(*sync.Map).Delete(seriesId)
+	}
+}
+
+// 删除已经不在MetricsMap中的指标的索引, 其中的PointCounter在清理时删除
+func (pcm *PointCounterManager) pruneIndex(metricsMap map[string]*metrics.StrategyMetric) {
+	pcm.byMetric.Range(func(k, _ interface{}) bool {
+		if metric := k.(*metrics.StrategyMetric); metricsMap[metric.Strategy.MetricName] != metric {
+			pcm.byMetric.Delete(k)
+		}
+		return true
+	})
+}
+
+// RangeSeries 抓取时遍历metric的全部series并计算当前值, 跳过超过series_ttl没有更新的series
+func (pcm *PointCounterManager) RangeSeries(metric *metrics.StrategyMetric, fn func(labelMap map[string]string, value float64)) {
+	v, ok := pcm.byMetric.Load(metric)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	v.(*sync.Map).Range(func(_, v interface{}) bool {
+		pc := v.(*PointCounter)
+		if !pc.Expired(now, metric.Strategy.SeriesTTL) {
+			fn(pc.LabelMap, pc.Value())
+		}
+		return true
+	})
+}
+
+// 调用方需持有cntMtx
+func (pcm *PointCounterManager) decSeries(metricsName string) {
+	if pcm.seriesCnt[metricsName]--; pcm.seriesCnt[metricsName] <= 0 {
+		delete(pcm.seriesCnt, metricsName)
+	}
+}
+
+// snapshot 获取全部series的快照, 导出时不持有任何分片锁
+func (pcm *PointCounterManager) snapshot() []seriesEntry {
+	pcm.cntMtx.Lock()
+	entries := make([]seriesEntry, 0, pcm.series)
+	pcm.cntMtx.Unlock()
+	for _, s := range pcm.shards {
+		s.series.Range(func(k, v interface{}) bool {
+			entries = append(entries, seriesEntry{seriesId: k.(string), pc: v.(*PointCounter)})
+			return true
+		})
+	}
+	return entries
+}
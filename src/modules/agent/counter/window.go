@@ -0,0 +1,98 @@
+package counter
+
+import (
+	"math"
+	"time"
+)
+
+// window max/min/avg的统计窗口
+// tumbling: 按窗口大小对齐的固定窗口, 导出上一个完整窗口的结果, 当前窗口结束后才可见
+// sliding: 将窗口切分为多个slot, 统计最近窗口大小时间内的slot(包含当前未结束的slot)
+type window struct {
+	slotSize time.Duration
+	slots    []windowSlot
+	tumbling bool
+}
+
+type windowSlot struct {
+	start int64 // slot起始时间(纳秒)
+	count int64
+	sum   float64
+	max   float64
+	min   float64
+}
+
+func newWindow(size time.Duration, sliding bool, slotNum int) *window {
+	if !sliding {
+		// 当前窗口以及上一个完整窗口
+		return &window{slotSize: size, slots: make([]windowSlot, 2), tumbling: true}
+	}
+	if slotNum < 1 {
+		slotNum = 1
+	}
+	return &window{
+		slotSize: size / time.Duration(slotNum),
+		slots:    make([]windowSlot, slotNum),
+	}
+}
+
+// 获取时间点所在的slot, slot已经过期时清空
+func (w *window) slot(now time.Time) *windowSlot {
+	start := now.Truncate(w.slotSize).UnixNano()
+	s := &w.slots[int((start/int64(w.slotSize))%int64(len(w.slots)))]
+	if s.start != start {
+		*s = windowSlot{start: start, max: math.NaN(), min: math.NaN()}
+	}
+	return s
+}
+
+// merge 将count个数值的sum/max/min合并到当前时间所在的slot
+func (w *window) merge(now time.Time, count int64, sum, max, min float64) {
+	s := w.slot(now)
+	s.count += count
+	s.sum += sum
+	if math.IsNaN(s.max) || max > s.max {
+		s.max = max
+	}
+	if math.IsNaN(s.min) || min < s.min {
+		s.min = min
+	}
+}
+
+// aggregate 汇总窗口内的slot, 窗口内没有数据时均为NaN
+func (w *window) aggregate(now time.Time) (max, min, avg float64) {
+	max, min, avg = math.NaN(), math.NaN(), math.NaN()
+	if w.tumbling {
+		// 上一个完整窗口, 避免刚进入新窗口时只能看到NaN或很少的数据
+		last := now.Truncate(w.slotSize).Add(-w.slotSize).UnixNano()
+		for _, s := range w.slots {
+			if s.count > 0 && s.start == last {
+				return s.max, s.min, s.sum / float64(s.count)
+			}
+		}
+		return max, min, avg
+	}
+	// 窗口内最早的slot起始时间
+	oldest := now.Truncate(w.slotSize).Add(-w.slotSize * time.Duration(len(w.slots)-1)).UnixNano()
+	var (
+		count int64
+		sum   float64
+	)
+	for _, s := range w.slots {
+		if s.count == 0 || s.start < oldest {
+			continue
+		}
+		count += s.count
+		sum += s.sum
+		if math.IsNaN(max) || s.max > max {
+			max = s.max
+		}
+		if math.IsNaN(min) || s.min < min {
+			min = s.min
+		}
+	}
+	if count > 0 {
+		avg = sum / float64(count)
+	}
+	return max, min, avg
+}
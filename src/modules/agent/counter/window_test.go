@@ -0,0 +1,49 @@
+package counter
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// tumbling导出上一个完整窗口, 刚进入新窗口时不会变为NaN
+func TestTumblingWindowReportsLastCompleteWindow(t *testing.T) {
+	w := newWindow(time.Minute, false, 0)
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	w.merge(base.Add(10*time.Second), 2, 30, 20, 10)
+	if max, _, _ := w.aggregate(base.Add(50 * time.Second)); !math.IsNaN(max) {
+		t.Errorf("current window reported before it completed: max %v", max)
+	}
+
+	w.merge(base.Add(70*time.Second), 1, 100, 100, 100)
+	max, min, avg := w.aggregate(base.Add(61 * time.Second))
+	if max != 20 || min != 10 || avg != 15 {
+		t.Errorf("after boundary got max %v min %v avg %v, want 20 10 15", max, min, avg)
+	}
+
+	max, min, avg = w.aggregate(base.Add(121 * time.Second))
+	if max != 100 || min != 100 || avg != 100 {
+		t.Errorf("next window got max %v min %v avg %v, want 100 100 100", max, min, avg)
+	}
+	// 上一个窗口没有数据
+	if max, _, _ = w.aggregate(base.Add(181 * time.Second)); !math.IsNaN(max) {
+		t.Errorf("empty window got max %v, want NaN", max)
+	}
+}
+
+// sliding统计最近window内的slot, 包含当前的slot
+func TestSlidingWindow(t *testing.T) {
+	w := newWindow(time.Minute, true, 6)
+	base := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	w.merge(base.Add(5*time.Second), 1, 50, 50, 50)
+	w.merge(base.Add(45*time.Second), 1, 10, 10, 10)
+	if max, min, avg := w.aggregate(base.Add(50 * time.Second)); max != 50 || min != 10 || avg != 30 {
+		t.Errorf("got max %v min %v avg %v, want 50 10 30", max, min, avg)
+	}
+	// 第一个slot已经滑出窗口
+	if max, min, avg := w.aggregate(base.Add(65 * time.Second)); max != 10 || min != 10 || avg != 10 {
+		t.Errorf("got max %v min %v avg %v, want 10 10 10", max, min, avg)
+	}
+}
@@ -3,7 +3,10 @@ package logjob
 import (
 	"context"
 	"log"
+	"log2metrics/src/modules/agent/checkpoint"
 	"log2metrics/src/modules/agent/consumer"
+	"log2metrics/src/modules/agent/reader"
+	"log2metrics/src/modules/metrics"
 	"sync"
 )
 
@@ -11,14 +14,18 @@ import (
 type LogJobManager struct {
 	targetMtx     sync.Mutex
 	activeTargets map[string]*LogJob
-	cq            chan *consumer.AnalysisPoint
+	cq            chan []*consumer.AnalysisPoint
+	checkpoint    *checkpoint.Store // 读取位置存储, 未开启时为nil
+	pool          *reader.Pool      // 按文件路径共享的reader
 }
 
 // NewLogJobManager return new logjob manager
-func NewLogJobManager(cq chan *consumer.AnalysisPoint) *LogJobManager {
+func NewLogJobManager(cq chan []*consumer.AnalysisPoint, store *checkpoint.Store) *LogJobManager {
 	return &LogJobManager{
 		activeTargets: make(map[string]*LogJob),
 		cq:            cq,
+		checkpoint:    store,
+		pool:          reader.NewPool(store),
 	}
 }
 
@@ -29,6 +36,10 @@ func (jm *LogJobManager) SyncManager(ctx context.Context, syncChan chan []*LogJo
 		case <-ctx.Done():
 			log.Println("logjob.SyncManager.receive_quit_signal_and_quit")
 			jm.StopAll()
+			// 全部reader停止后记录的读取位置才是最终的, 此时落盘
+			if err := jm.checkpoint.Flush(); err != nil {
+				log.Printf("%+v", err)
+			}
 			return nil
 		case jobs := <-syncChan:
 			// 获取到具体的jobs后, 传入jobs参数调用Manager的sync方法
@@ -71,11 +82,20 @@ func (jm *LogJobManager) Sync(jobs []*LogJob) {
 		// 以hash为key job为value放入圈梁jobs map里面
 		thisAllTargets[hash] = job
 		// 如果在activeTarget Map中找不到当前job的hash key, 说明这个job是个增量job
-		if _, loaded := jm.activeTargets[hash]; !loaded {
+		activeJob, loaded := jm.activeTargets[hash]
+		if !loaded {
 			// 那么就将这个增量Job 添加到增量job Map中
 			thisNewTargets[hash] = job
 			// 并且往activeTarget将这个job添加进去
 			jm.activeTargets[hash] = job
+			continue
+		}
+		// hash相同但指纹不同, 说明策略的pattern/func/tags等内容被修改, 需要停止旧job并在原位置重新启动
+		if activeJob.fingerprint() != job.fingerprint() {
+			log.Printf("LogJobManager.Sync: restart modified job stra:%+v", job.Strategy)
+			activeJob.stop()
+			thisNewTargets[hash] = job
+			jm.activeTargets[hash] = job
 		}
 	}
 
@@ -91,6 +111,7 @@ func (jm *LogJobManager) Sync(jobs []*LogJob) {
 			delete(jm.activeTargets, hash)
 		}
 	}
+	metrics.ActiveJobs.Set(float64(len(jm.activeTargets)))
 	// 释放锁
 	jm.targetMtx.Unlock()
 
@@ -99,8 +120,10 @@ func (jm *LogJobManager) Sync(jobs []*LogJob) {
 		//fmt.Println("lj")
 		job := job
 		// 启动job并且传入cq 用以传到AnalysisPoint到计算部分
-		job.start(jm.cq)
+		job.start(jm.cq, jm.pool)
 
 	}
+	// 同一个文件的全部新订阅加入后再启动reader, 起始位置取各策略中最早的位置
+	jm.pool.StartPending()
 
 }
@@ -3,17 +3,30 @@ package logjob
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"io"
 	"log"
 	"log2metrics/src/common"
 	"log2metrics/src/modules/agent/config"
 	"log2metrics/src/modules/agent/consumer"
 	"log2metrics/src/modules/agent/reader"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 type LogJob struct {
-	r        *reader.Reader          // 日志生产者(读取日志)
-	cg       *consumer.ConsumerGroup // 日志消费者组
-	Strategy *config.LogStrategy     // 日志策略
+	sync.Mutex
+	targets  map[string]*fileTarget // 当前采集的文件, key为文件路径
+	skipped  map[string]string      // 已经以其它路径读取而跳过的文件, value为读取该文件的路径
+	close    chan struct{}          // 控制文件扫描goroutine生命周期
+	pool     *reader.Pool           // 按文件路径共享的reader
+	Strategy *config.LogStrategy    // 日志策略
+}
+
+// fileTarget file_path(glob/目录)匹配到的单个文件, 每个文件有对该文件reader的订阅和独立的consumerGroup
+type fileTarget struct {
+	sub *reader.Subscription    // 日志生产者(共享reader的订阅)
+	cg  *consumer.ConsumerGroup // 日志消费者组
 }
 
 func (lj *LogJob) hash() string {
@@ -24,42 +37,141 @@ func (lj *LogJob) hash() string {
 	return hex.EncodeToString(md5obj.Sum(nil))
 }
 
-func (lj *LogJob) start(cq chan *consumer.AnalysisPoint) {
+// 策略内容的指纹, 用于判断同一个job的策略是否被修改
+func (lj *LogJob) fingerprint() string {
+	return lj.Strategy.Fingerprint()
+}
+
+// start 订阅file_path匹配到的文件, 新建的reader由调用方通过pool.StartPending统一启动
+func (lj *LogJob) start(cq chan []*consumer.AnalysisPoint, pool *reader.Pool) {
+	lj.targets = make(map[string]*fileTarget)
+	lj.skipped = make(map[string]string)
+	lj.close = make(chan struct{})
+	lj.pool = pool
+
+	// 首次扫描到的文件按照read_from决定起始读取位置
+	lj.scan(cq, lj.Strategy.ReadPosition)
+
+	// 定期重新扫描file_path, 为新出现的文件启动reader, 回收已经不存在的文件的reader
+	go func() {
+		ticker := time.NewTicker(common.FileScanInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lj.close:
+				return
+			case <-ticker.C:
+				// 之后新出现的文件从头部开始读取, 避免丢失文件创建到被发现之间写入的日志
+				lj.scan(cq, &config.ReadPosition{Whence: io.SeekStart})
+				lj.pool.StartPending()
+			}
+		}
+	}()
+
+	// 打印当前MetricsName和对应的日志文件路径
+	log.Printf("[lojob.start: create logJob successfully][filepath:%s][sid:%s]", lj.Strategy.FilePath, lj.Strategy.MetricName)
+}
+
+// 扫描file_path匹配到的文件, 增量启动/停止fileTarget
+func (lj *LogJob) scan(cq chan []*consumer.AnalysisPoint, position *config.ReadPosition) {
+	files, err := reader.Glob(lj.Strategy.FilePath, lj.Strategy.IncludeRotated)
+	if err != nil {
+		log.Printf("%+v\n", err)
+		return
+	}
+
+	lj.Lock()
+	defer lj.Unlock()
+	// job已经被停止
+	select {
+	case <-lj.close:
+		return
+	default:
+	}
 
-	// 获取当前策略的文件路径
-	filePath := lj.Strategy.FilePath
+	matched := make(map[string]struct{}, len(files))
+	for _, filePath := range files {
+		matched[filePath] = struct{}{}
+		if t, loaded := lj.targets[filePath]; loaded {
+			if !t.sub.Removed() {
+				continue
+			}
+			// reader启动失败时订阅已经被取消, 重新订阅
+			t.stop(lj.pool)
+			delete(lj.targets, filePath)
+		}
+		// 目录和glob匹配到的文件已经以其它路径读取时跳过, 避免滚动后重命名的文件从头重复统计
+		if filePath != filepath.Clean(lj.Strategy.FilePath) {
+			if path, tailed := lj.pool.Tailed(filePath); tailed {
+				if lj.skipped[filePath] != path {
+					log.Printf("[lojob.scan: file already read as another path, skip][filepath:%s][path:%s][sid:%s]", filePath, path, lj.Strategy.MetricName)
+					lj.skipped[filePath] = path
+				}
+				continue
+			}
+			delete(lj.skipped, filePath)
+		}
+		t, err := newFileTarget(filePath, position, lj.Strategy, cq, lj.pool)
+		if err != nil {
+			log.Printf("%+v\n", err)
+			continue
+		}
+		lj.targets[filePath] = t
+		log.Printf("[lojob.scan: start reading file][filepath:%s][sid:%s]", filePath, lj.Strategy.MetricName)
+	}
+
+	// 普通文件路径暂时不存在时(如日志滚动), 交由tailer负责重新打开, 不回收reader
+	if !reader.HasMeta(lj.Strategy.FilePath) && len(files) == 0 {
+		return
+	}
+	for filePath := range lj.skipped {
+		if _, loaded := matched[filePath]; !loaded {
+			delete(lj.skipped, filePath)
+		}
+	}
+	for filePath, t := range lj.targets {
+		if _, loaded := matched[filePath]; !loaded {
+			log.Printf("[lojob.scan: file no longer matched, stop reading][filepath:%s][sid:%s]", filePath, lj.Strategy.MetricName)
+			t.stop(lj.pool)
+			delete(lj.targets, filePath)
+		}
+	}
+}
+
+func newFileTarget(filePath string, position *config.ReadPosition, strategy *config.LogStrategy, cq chan []*consumer.AnalysisPoint, pool *reader.Pool) (*fileTarget, error) {
 	// 初始化string chan, 日志采集完毕后通过该chan与消费者构成生产者消费者模型
 	stream := make(chan string, common.LogQueueSize)
 
-	// 构建reader, 后面会作为logJob的reader结构体成员
-	r, err := reader.NewReader(filePath, stream)
+	// 订阅文件的reader, 同一个文件的多个策略共享一个reader
+	sub, err := pool.Acquire(filePath, strategy, position, stream)
 	if err != nil {
-		log.Printf("%+v\n", err)
+		return nil, err
 	}
-	// 实例化reader成员
-	lj.r = r
 
 	// 生成消费者组, 传入filePath，
 	//  与生产者构成生产消费模型的stream(日志传输chan),
 	//  log的策略,
 	//  还有AnalysisPoint Chan, 为counterQueue, 消费者在正则处理完毕后会构造AnalysisPoint通过该chan给counter进行消费
-	cg := consumer.NewConsumerGroup(filePath, stream, lj.Strategy, cq)
-
-	// 将消费者组赋予当前logJob
-	lj.cg = cg
+	cg := consumer.NewConsumerGroup(filePath, stream, strategy, cq)
 
+	t := &fileTarget{sub: sub, cg: cg}
 	// 启动消费者组从stream chan消费日志
-	lj.cg.Start()
-	// 启动生产者读取日志
-	go lj.r.Start()
+	t.cg.Start()
+	return t, nil
+}
 
-	// 打印当前MetricsName和对应的日志文件路径
-	log.Printf("[lojob.start: create logJob successfully][filepath:%s][sid:%s]", filePath, lj.Strategy.MetricName)
+func (t *fileTarget) stop(pool *reader.Pool) {
+	// 先取消订阅, 最后一个订阅取消时reader停止
+	pool.Release(t.sub)
+	// 再停消费者
+	t.cg.Stop()
 }
 
 func (lj *LogJob) stop() {
-	// 先停生产者
-	lj.r.Stop()
-	// 再停消费者
-	lj.cg.Stop()
+	lj.Lock()
+	defer lj.Unlock()
+	close(lj.close)
+	for _, t := range lj.targets {
+		t.stop(lj.pool)
+	}
 }
@@ -0,0 +1,111 @@
+package reader
+
+// ahoCorasick 多字面量匹配自动机, 一次扫描即可找出文本中出现的全部字面量
+// 只出现在字面量中的字节才分配独立的字节类, 其余字节共用0号类, 以减小状态转移表
+type ahoCorasick struct {
+	classes  [256]int // 字节对应的字节类
+	nclass   int
+	delta    []int32 // 状态转移表, 下标为 state*nclass+class
+	out      [][]int // 到达该状态时出现的字面量编号, 已经合并了fail链上的输出
+	final    []bool  // 扫描时使用的状态为 state*nclass, final标记该状态是否有输出, 避免每个字节都做除法
+	literals int
+}
+
+func newAhoCorasick(literals []string) *ahoCorasick {
+	ac := &ahoCorasick{nclass: 1, literals: len(literals)}
+	for _, literal := range literals {
+		for i := 0; i < len(literal); i++ {
+			if ac.classes[literal[i]] == 0 {
+				ac.classes[literal[i]] = ac.nclass
+				ac.nclass++
+			}
+		}
+	}
+
+	// 构建trie, -1表示没有对应的子节点
+	ac.addState()
+	for id, literal := range literals {
+		state := 0
+		for i := 0; i < len(literal); i++ {
+			idx := state*ac.nclass + ac.classes[literal[i]]
+			if ac.delta[idx] < 0 {
+				ac.delta[idx] = int32(ac.addState())
+			}
+			state = int(ac.delta[idx])
+		}
+		ac.out[state] = append(ac.out[state], id)
+	}
+
+	// 按层计算fail链, 并将缺失的转移补全为fail状态的转移, 得到完整的DFA
+	fail := make([]int, len(ac.out))
+	var queue []int
+	for c := 0; c < ac.nclass; c++ {
+		if next := ac.delta[c]; next < 0 {
+			ac.delta[c] = 0
+		} else {
+			queue = append(queue, int(next))
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		ac.out[state] = append(ac.out[state], ac.out[fail[state]]...)
+		for c := 0; c < ac.nclass; c++ {
+			idx := state*ac.nclass + c
+			failNext := ac.delta[fail[state]*ac.nclass+c]
+			if ac.delta[idx] < 0 {
+				ac.delta[idx] = failNext
+				continue
+			}
+			next := int(ac.delta[idx])
+			fail[next] = int(failNext)
+			queue = append(queue, next)
+		}
+	}
+
+	// 转移表中的状态预先乘以nclass
+	ac.final = make([]bool, len(ac.delta))
+	for i := range ac.delta {
+		ac.delta[i] *= int32(ac.nclass)
+	}
+	for state, out := range ac.out {
+		ac.final[state*ac.nclass] = len(out) > 0
+	}
+	return ac
+}
+
+func (ac *ahoCorasick) addState() int {
+	for c := 0; c < ac.nclass; c++ {
+		ac.delta = append(ac.delta, -1)
+	}
+	ac.out = append(ac.out, nil)
+	return len(ac.out) - 1
+}
+
+// scan 扫描文本, 将出现的字面量在found中标记为true, 返回出现的字面量数量
+func (ac *ahoCorasick) scan(text string, found []bool) int {
+	for i := range found {
+		found[i] = false
+	}
+	var (
+		state int
+		cnt   int
+	)
+	for i := 0; i < len(text); i++ {
+		state = int(ac.delta[state+ac.classes[text[i]]])
+		if !ac.final[state] {
+			continue
+		}
+		for _, id := range ac.out[state/ac.nclass] {
+			if !found[id] {
+				found[id] = true
+				cnt++
+			}
+		}
+		// 全部字面量都已出现时无需继续扫描
+		if cnt == ac.literals {
+			break
+		}
+	}
+	return cnt
+}
@@ -0,0 +1,88 @@
+package reader
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 逐个字面量使用strings.Contains得到的结果
+func naiveScan(literals []string, text string) []bool {
+	found := make([]bool, len(literals))
+	for i, literal := range literals {
+		found[i] = strings.Contains(text, literal)
+	}
+	return found
+}
+
+func TestAhoCorasickScan(t *testing.T) {
+	cases := []struct {
+		name     string
+		literals []string
+		text     string
+		want     []bool
+	}{
+		{"none", []string{"foo", "bar"}, "hello world", []bool{false, false}},
+		{"all", []string{"foo", "bar"}, "bar foo", []bool{true, true}},
+		// 经典的重叠字面量: ushers中同时出现she/he/hers, 没有his
+		{"overlap", []string{"he", "she", "his", "hers"}, "ushers", []bool{true, true, false, true}},
+		// bc只能通过abc状态的fail链输出
+		{"fail link output", []string{"abcd", "bc"}, "xabcx", []bool{false, true}},
+		{"fail link output chain", []string{"abcde", "bcd", "cd", "d"}, "abcdx", []bool{false, true, true, true}},
+		{"suffix of longer literal", []string{"code=5", "de=5"}, "[code=502]", []bool{true, true}},
+		{"shared prefix", []string{"status=", "statuses"}, "statuses status=", []bool{true, true}},
+		{"fail restart", []string{"aab"}, "aaab", []bool{true}},
+		{"literal is whole text", []string{"GET /"}, "GET /", []bool{true}},
+		{"prefix only", []string{"GET /api"}, "GET /ap", []bool{false}},
+		{"bytes outside literals", []string{"ab"}, "a\xffb\x00ab", []bool{true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ac := newAhoCorasick(c.literals)
+			found := make([]bool, len(c.literals))
+			cnt := ac.scan(c.text, found)
+			if !reflect.DeepEqual(found, c.want) {
+				t.Errorf("scan(%q) found %v, want %v", c.text, found, c.want)
+			}
+			want := 0
+			for _, f := range c.want {
+				if f {
+					want++
+				}
+			}
+			if cnt != want {
+				t.Errorf("scan(%q) returned %d, want %d", c.text, cnt, want)
+			}
+			if naive := naiveScan(c.literals, c.text); !reflect.DeepEqual(naive, c.want) {
+				t.Fatalf("bad case: strings.Contains gives %v", naive)
+			}
+		})
+	}
+}
+
+// found在每次扫描前重置, 上一行的结果不会残留
+func TestAhoCorasickScanResetsFound(t *testing.T) {
+	ac := newAhoCorasick([]string{"foo", "bar"})
+	found := make([]bool, 2)
+	ac.scan("foo bar", found)
+	if cnt := ac.scan("bar", found); cnt != 1 || found[0] || !found[1] {
+		t.Errorf("second scan found %v (cnt %d), want [false true]", found, cnt)
+	}
+}
+
+// 与strings.Contains对比, 覆盖字面量相互包含、重叠以及字节类之外的字节
+func TestAhoCorasickMatchesContains(t *testing.T) {
+	literals := []string{"a", "ab", "bab", "bc", "bca", "c", "caa", "abcab", "[code=", "] 1"}
+	texts := []string{
+		"", "a", "abccab", "bababc", "xyz", "caab", "abcabcab",
+		"1.1.1.1 [code=200] 1024", "zzzzbcazzzz", "cccccc", "\x00ab\xff",
+	}
+	ac := newAhoCorasick(literals)
+	found := make([]bool, len(literals))
+	for _, text := range texts {
+		ac.scan(text, found)
+		if want := naiveScan(literals, text); !reflect.DeepEqual(found, want) {
+			t.Errorf("scan(%q) found %v, want %v", text, found, want)
+		}
+	}
+}
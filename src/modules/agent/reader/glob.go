@@ -0,0 +1,171 @@
+package reader
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// globDoubleStar 匹配任意层级目录
+const globDoubleStar = "**"
+
+// 日志滚动后的文件名后缀, 如 app.log.1、app.log-20240101、0.log.20240101-123456(kubelet)、app.log.2024-01-01
+var rotatedSuffix = regexp.MustCompile(`(\.\d+|[.-]\d{8}([-_T]?\d{2,6})?|[.-]\d{4}-\d{2}-\d{2}([-_T][\d:-]+)?)$`)
+
+// 压缩文件的扩展名, 这些文件不能按文本读取
+var compressedExts = map[string]bool{
+	".gz": true, ".bz2": true, ".xz": true, ".zst": true, ".lz4": true, ".zip": true, ".tgz": true, ".tar": true,
+}
+
+// IsRotated 判断文件是否为滚动或压缩后的日志文件, 其内容已经通过原文件读取过
+func IsRotated(path string) bool {
+	name := filepath.Base(path)
+	if compressedExts[strings.ToLower(filepath.Ext(name))] {
+		return true
+	}
+	return rotatedSuffix.MatchString(name)
+}
+
+// HasMeta 判断路径中是否包含glob通配符
+func HasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// Glob 根据file_path查找需要采集的文件, 只返回普通文件
+//  1. 普通路径: 文件存在则直接返回
+//  2. 目录: 返回目录下的全部文件(不递归)
+//  3. glob: 支持filepath.Match的语法, 以及用 ** 匹配任意层级目录
+//
+// 目录和glob默认跳过滚动或压缩后的文件(见IsRotated), includeRotated为true时保留
+func Glob(pattern string, includeRotated bool) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	if !HasMeta(pattern) {
+		fi, err := os.Stat(pattern)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, errors.Wrapf(err, "reader.Glob: stat file failed: %s", pattern)
+		}
+		// 明确指定的文件总是采集
+		if !fi.IsDir() {
+			return []string{pattern}, nil
+		}
+		// 目录则采集目录下的全部文件
+		pattern = filepath.Join(pattern, "*")
+	}
+	matches, err := glob(pattern)
+	if err != nil || includeRotated {
+		return matches, err
+	}
+	res := matches[:0]
+	for _, m := range matches {
+		if !IsRotated(m) {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+// glob 查找匹配pattern的普通文件
+func glob(pattern string) ([]string, error) {
+	// 不包含 ** 时直接使用标准库的Glob
+	if !strings.Contains(pattern, globDoubleStar) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reader.Glob: bad pattern: %s", pattern)
+		}
+		return regularFiles(matches), nil
+	}
+
+	// 以第一个包含通配符的层级之前的部分作为遍历的根目录
+	segments := strings.Split(pattern, string(filepath.Separator))
+	i := 0
+	for i < len(segments) && !HasMeta(segments[i]) {
+		i++
+	}
+	root := strings.Join(segments[:i], string(filepath.Separator))
+	if root == "" {
+		if filepath.IsAbs(pattern) {
+			root = string(filepath.Separator)
+		} else {
+			root = "."
+		}
+	}
+	patternSegments := segments[i:]
+	// 提前校验pattern语法, 避免遍历时每个文件都返回错误
+	for _, seg := range patternSegments {
+		if _, err := filepath.Match(seg, ""); err != nil {
+			return nil, errors.Wrapf(err, "reader.Glob: bad pattern: %s", pattern)
+		}
+	}
+
+	var matches []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 无权限等错误的目录直接跳过
+			return nil
+		}
+		// 与非 ** 的情况一致, 符号链接以其指向的文件为准, 如/var/log/containers下指向各pod日志的链接
+		// 指向目录的符号链接不会继续遍历
+		if d.Type()&fs.ModeSymlink != 0 {
+			fi, err := os.Stat(path)
+			if err != nil || !fi.Mode().IsRegular() {
+				return nil
+			}
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if matchSegments(patternSegments, strings.Split(rel, string(filepath.Separator))) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "reader.Glob: walk dir failed: %s", root)
+	}
+	return matches, nil
+}
+
+// matchSegments 按层级匹配路径, ** 可以匹配零个或多个层级
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == globDoubleStar {
+		for k := 0; k <= len(path); k++ {
+			if matchSegments(pattern[1:], path[k:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// 过滤掉目录等非普通文件
+func regularFiles(paths []string) []string {
+	res := make([]string, 0, len(paths))
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		res = append(res, p)
+	}
+	return res
+}
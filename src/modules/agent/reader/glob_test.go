@@ -0,0 +1,80 @@
+package reader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsRotated(t *testing.T) {
+	cases := []struct {
+		path string
+		want bool
+	}{
+		{"/var/log/app.log", false},
+		{"/var/log/pods/ns_pod_uid/app/0.log", false},
+		{"/var/log/app-2.log", false},
+		{"/var/log/app.log.1", true},
+		{"/var/log/app.log.12", true},
+		{"/var/log/app.log-20240101", true},
+		{"/var/log/app.log-2024010112", true},
+		{"/var/log/app.log.2024-01-01", true},
+		{"/var/log/pods/ns_pod_uid/app/0.log.20240101-123456", true},
+		{"/var/log/app.log.1.gz", true},
+		{"/var/log/app.log.gz", true},
+		{"/var/log/app.log.ZST", true},
+		{"/var/log/app.log.bz2", true},
+	}
+	for _, c := range cases {
+		if got := IsRotated(c.path); got != c.want {
+			t.Errorf("IsRotated(%q) = %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+func touch(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("line\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 目录和glob默认跳过滚动或压缩后的文件, 明确指定的文件总是采集
+func TestGlobSkipsRotated(t *testing.T) {
+	dir := t.TempDir()
+	app := filepath.Join(dir, "app.log")
+	rotated := filepath.Join(dir, "app.log.1")
+	gz := filepath.Join(dir, "app.log.2.gz")
+	pod := filepath.Join(dir, "pods", "app", "0.log")
+	podRotated := filepath.Join(dir, "pods", "app", "0.log.20240101-123456")
+	touch(t, app, rotated, gz, pod, podRotated)
+
+	cases := []struct {
+		pattern        string
+		includeRotated bool
+		want           []string
+	}{
+		{dir, false, []string{app}},
+		{dir, true, []string{app, rotated, gz}},
+		{filepath.Join(dir, "app.log*"), false, []string{app}},
+		{filepath.Join(dir, "**", "*.log*"), false, []string{app, pod}},
+		{filepath.Join(dir, "**", "*.log*"), true, []string{app, rotated, gz, pod, podRotated}},
+		{rotated, false, []string{rotated}},
+	}
+	for _, c := range cases {
+		got, err := Glob(c.pattern, c.includeRotated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Glob(%q, %v) = %q, want %q", c.pattern, c.includeRotated, got, c.want)
+		}
+	}
+}
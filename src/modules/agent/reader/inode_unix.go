@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package reader
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode 获取文件的device和inode, 用来识别文件滚动
+func fileInode(fi os.FileInfo) (dev, ino uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Ino)
+}
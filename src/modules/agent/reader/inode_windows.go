@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package reader
+
+import "os"
+
+// fileInode windows下没有inode, 只能依赖路径识别文件
+func fileInode(fi os.FileInfo) (dev, ino uint64) {
+	return 0, 0
+}
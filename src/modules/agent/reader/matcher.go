@@ -0,0 +1,88 @@
+package reader
+
+// 合并匹配的结果
+const (
+	matchPass    = iota // 可能匹配, 推送给策略的消费者
+	missContains        // 缺少contains字面量
+	missLiteral         // 缺少主正则必然包含的字面量, 不可能匹配主正则
+)
+
+// matcher 合并读取同一文件的全部策略的字面量, 每行只扫描一次, 再按策略分发
+// 不可能匹配的行在Reader中直接过滤, 不再推送到对应策略的Stream, 也不再由消费者逐个执行正则
+type matcher struct {
+	ac    *ahoCorasick
+	rules []matchRule // 与订阅一一对应
+	found []bool      // 最近一次扫描的结果, 只在读取goroutine中使用
+}
+
+// matchRule 策略需要的字面量编号
+type matchRule struct {
+	contains []int
+	literals []int
+}
+
+// newMatcher 根据订阅构建合并匹配器, 少于两个订阅需要字面量时返回nil
+// 只有一个策略时合并扫描不能减少正则的执行次数, 反而多了一次扫描, 由消费者直接执行正则
+func newMatcher(subs []*Subscription) *matcher {
+	var (
+		literals []string
+		ids      = make(map[string]int)
+	)
+	id := func(literal string) int {
+		if i, ok := ids[literal]; ok {
+			return i
+		}
+		ids[literal] = len(literals)
+		literals = append(literals, literal)
+		return ids[literal]
+	}
+	m := &matcher{rules: make([]matchRule, len(subs))}
+	ruled := 0
+	for i, s := range subs {
+		// 多行日志需要组装为事件后才能判断, 由消费者处理
+		if s.multiline != nil {
+			continue
+		}
+		for _, literal := range s.Strategy.Contains {
+			m.rules[i].contains = append(m.rules[i].contains, id(literal))
+		}
+		for _, literal := range s.Strategy.Literals {
+			m.rules[i].literals = append(m.rules[i].literals, id(literal))
+		}
+		if len(m.rules[i].contains)+len(m.rules[i].literals) > 0 {
+			ruled++
+		}
+	}
+	if ruled < 2 {
+		return nil
+	}
+	m.ac = newAhoCorasick(literals)
+	m.found = make([]bool, len(literals))
+	return m
+}
+
+// scan 扫描一行日志, 之后通过result获取各订阅的匹配结果
+func (m *matcher) scan(text string) {
+	if m == nil {
+		return
+	}
+	m.ac.scan(text, m.found)
+}
+
+// result 第i个订阅对最近一次扫描的行的匹配结果
+func (m *matcher) result(i int) int {
+	if m == nil {
+		return matchPass
+	}
+	for _, id := range m.rules[i].contains {
+		if !m.found[id] {
+			return missContains
+		}
+	}
+	for _, id := range m.rules[i].literals {
+		if !m.found[id] {
+			return missLiteral
+		}
+	}
+	return matchPass
+}
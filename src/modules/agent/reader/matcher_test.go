@@ -0,0 +1,167 @@
+package reader
+
+import (
+	"fmt"
+	"io"
+	"log2metrics/src/modules/agent/config"
+	"testing"
+)
+
+// 与agent一样校验策略并由config提取主正则的字面量
+func parseStrategies(tb testing.TB, ss ...*config.LogStrategy) []*config.LogStrategy {
+	tb.Helper()
+	res := config.ParseStrategies(ss, nil)
+	if len(res) != len(ss) {
+		tb.Fatalf("parsed %d strategies, want %d", len(res), len(ss))
+	}
+	return res
+}
+
+func subscriptionsOf(ss []*config.LogStrategy) []*Subscription {
+	subs := make([]*Subscription, 0, len(ss))
+	for _, st := range ss {
+		subs = append(subs, &Subscription{Strategy: st, multiline: newMultiline(st.Multiline)})
+	}
+	return subs
+}
+
+func TestMatcherResult(t *testing.T) {
+	ss := parseStrategies(t,
+		&config.LogStrategy{MetricName: "code_5xx", FilePath: "access.log", Pattern: `\[code=(5\d\d)\] (\d+)`},
+		&config.LogStrategy{MetricName: "api_get", FilePath: "access.log", Pattern: `"GET /api/`, Contains: []string{"POST"}},
+		&config.LogStrategy{MetricName: "any_line", FilePath: "access.log", Pattern: `(\d+)`},
+		&config.LogStrategy{MetricName: "java_error", FilePath: "access.log", Pattern: `Exception`,
+			Multiline: &config.Multiline{StartPattern: `^\d{4}-`}},
+	)
+	m := newMatcher(subscriptionsOf(ss))
+	cases := []struct {
+		line string
+		want []int
+	}{
+		{`"GET /api/v1" [code=502] 76`, []int{matchPass, missContains, matchPass, matchPass}},
+		{`"POST /api/v1" [code=200] 76`, []int{matchPass, missLiteral, matchPass, matchPass}},
+		{`"GET /api/v1" POST`, []int{missLiteral, matchPass, matchPass, matchPass}},
+		{`plain text`, []int{missLiteral, missContains, matchPass, matchPass}},
+	}
+	for _, c := range cases {
+		m.scan(c.line)
+		for i, want := range c.want {
+			if got := m.result(i); got != want {
+				t.Errorf("line %q strategy %s: result %d, want %d", c.line, ss[i].MetricName, got, want)
+			}
+		}
+	}
+}
+
+// 没有任何策略需要字面量时不构建matcher, 全部行都推送给消费者
+func TestMatcherWithoutLiterals(t *testing.T) {
+	ss := parseStrategies(t, &config.LogStrategy{MetricName: "any_line", FilePath: "access.log", Pattern: `(\d+)`})
+	m := newMatcher(subscriptionsOf(ss))
+	if m != nil {
+		t.Fatalf("newMatcher built a matcher without literals")
+	}
+	m.scan("anything")
+	if got := m.result(0); got != matchPass {
+		t.Errorf("nil matcher result %d, want matchPass", got)
+	}
+}
+
+// 只有一个订阅需要字面量时不构建matcher, 由消费者直接执行正则
+func TestMatcherSingleStrategy(t *testing.T) {
+	ss := parseStrategies(t,
+		&config.LogStrategy{MetricName: "code_5xx", FilePath: "access.log", Pattern: `\[code=(5\d\d)\] (\d+)`},
+		&config.LogStrategy{MetricName: "any_line", FilePath: "access.log", Pattern: `(\d+)`},
+	)
+	if m := newMatcher(subscriptionsOf(ss[:1])); m != nil {
+		t.Errorf("newMatcher built a matcher for a single strategy")
+	}
+	if m := newMatcher(subscriptionsOf(ss)); m != nil {
+		t.Errorf("newMatcher built a matcher with only one strategy having literals")
+	}
+}
+
+// 与nginx_log_generator相同格式的日志, 路径为/svc<k>/..., k在[0, 100)中均匀分布
+func benchmarkLines() []string {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`187.167.%d.211 - - [29/Dec/2021:22:01:14 +0800] "GET /svc%d/executive_Synchronised.php HTTP/1.1" [code=%d] %d "-" "Mozilla/5.0 (X11; Linux x86_64) Presto/2.8.242 Version/13.00"`,
+			i%256, i*7%100, []int{200, 200, 200, 302, 404, 502}[i%6], 800+i)
+	}
+	return lines
+}
+
+// n个策略分别统计各自服务的响应码, 每行最多匹配其中一个策略
+func benchmarkStrategies(b *testing.B, n int) []*config.LogStrategy {
+	ss := make([]*config.LogStrategy, n)
+	for i := range ss {
+		ss[i] = &config.LogStrategy{
+			MetricName: fmt.Sprintf("svc%d_code", i),
+			FilePath:   "access.log",
+			Pattern:    fmt.Sprintf(`"GET /svc%d/\S* HTTP/1\.1" \[code=(\d+)\] (\d+)`, i),
+		}
+	}
+	return parseStrategies(b, ss...)
+}
+
+// 读取access.log的Reader, 每个策略一个订阅, 返回各订阅的Stream
+func benchmarkReader(b *testing.B, ss []*config.LogStrategy) (*Reader, []chan string) {
+	r := NewReader("access.log", nil)
+	streams := make([]chan string, len(ss))
+	for i, st := range ss {
+		streams[i] = make(chan string, 16)
+		s := newSubscription(r.FilePath, st, &config.ReadPosition{Whence: io.SeekStart}, streams[i])
+		s.init(0, false)
+		r.subscribe(s)
+		b.Cleanup(s.deleteMetrics)
+	}
+	return r, streams
+}
+
+// BenchmarkDispatch 同一文件的n个正则策略, 每行经Reader.dispatch推送后由消费者执行主正则的总耗时(ns/op即ns/line)
+//
+//	per_consumer: 不合并扫描, 每行推送给全部策略, 由各自的消费者执行主正则
+//	combined: 与Reader相同, 两个以上的策略需要字面量时合并扫描, 只推送可能匹配的行
+func BenchmarkDispatch(b *testing.B) {
+	lines := benchmarkLines()
+	for _, n := range []int{1, 10, 50} {
+		ss := benchmarkStrategies(b, n)
+		for _, combined := range []bool{false, true} {
+			name := fmt.Sprintf("strategies=%d/per_consumer", n)
+			if combined {
+				name = fmt.Sprintf("strategies=%d/combined", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				r, streams := benchmarkReader(b, ss)
+				if !combined {
+					r.matcher = nil
+				}
+				matched := 0
+				var offset int64
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					line := lines[i%len(lines)]
+					end := offset + int64(len(line)) + 1
+					r.dispatch(line, offset, end)
+					offset = end
+					// 消费者对推送过来的行执行主正则
+					for j, stream := range streams {
+						select {
+						case text := <-stream:
+							if ss[j].PatternReg.FindStringSubmatch(text) != nil {
+								matched++
+							}
+						default:
+						}
+					}
+				}
+				b.StopTimer()
+				reportMatched(b, matched)
+			})
+		}
+	}
+}
+
+// 两种方式匹配到的行数应当一致
+func reportMatched(b *testing.B, matched int) {
+	b.ReportMetric(float64(matched)/float64(b.N), "matched/line")
+}
@@ -0,0 +1,67 @@
+package reader
+
+import (
+	"log2metrics/src/modules/agent/config"
+	"strings"
+	"time"
+)
+
+// multiline 将属于同一个事件的多行日志组装在一起
+type multiline struct {
+	conf    *config.Multiline
+	lines   []string
+	lastAdd time.Time // 最近一次添加行的时间, 用于判断推送超时
+}
+
+func newMultiline(conf *config.Multiline) *multiline {
+	if conf == nil {
+		return nil
+	}
+	return &multiline{conf: conf}
+}
+
+// add 添加一行, 当该行开始了新的事件时返回之前组装好的事件
+func (m *multiline) add(line string) (string, bool) {
+	var (
+		event string
+		ok    bool
+	)
+	if len(m.lines) > 0 && (m.isStart(line) || len(m.lines) >= m.conf.MaxLines) {
+		event, ok = m.flush()
+	}
+	m.lines = append(m.lines, line)
+	m.lastAdd = time.Now()
+	return event, ok
+}
+
+// 判断该行是否开始了新的事件
+func (m *multiline) isStart(line string) bool {
+	if m.conf.StartReg != nil && m.conf.StartReg.MatchString(line) {
+		return true
+	}
+	// 只配置了start_pattern时, 其余行都是当前事件的后续行
+	if m.conf.ContinueReg == nil {
+		return false
+	}
+	return !m.conf.ContinueReg.MatchString(line)
+}
+
+// flush 返回当前组装好的事件并清空
+func (m *multiline) flush() (string, bool) {
+	if len(m.lines) == 0 {
+		return "", false
+	}
+	event := strings.Join(m.lines, "\n")
+	m.lines = m.lines[:0]
+	return event, true
+}
+
+// pending 是否存在未推送的事件
+func (m *multiline) pending() bool {
+	return len(m.lines) > 0
+}
+
+// deadline 当前事件的推送超时时间
+func (m *multiline) deadline() time.Time {
+	return m.lastAdd.Add(m.conf.FlushTimeout)
+}
@@ -0,0 +1,129 @@
+package reader
+
+import (
+	"io"
+	"log"
+	"log2metrics/src/modules/agent/checkpoint"
+	"log2metrics/src/modules/agent/config"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Pool 按文件路径共享Reader, 多个策略读取同一个文件时只打开一个tailer, 最后一个订阅取消时关闭
+type Pool struct {
+	sync.Mutex
+	readers    map[string]*Reader
+	checkpoint *checkpoint.Store
+}
+
+func NewPool(store *checkpoint.Store) *Pool {
+	return &Pool{
+		readers:    make(map[string]*Reader),
+		checkpoint: store,
+	}
+}
+
+// Acquire 订阅文件, position为该策略的起始读取位置, 读取到的日志推送到stream
+// 文件还没有Reader时新建Reader, 需要调用StartPending后才开始读取, 以便同时加入的订阅一起决定起始位置
+func (p *Pool) Acquire(filePath string, strategy *config.LogStrategy, position *config.ReadPosition, stream chan string) (*Subscription, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, errors.Wrap(err, "reader.Pool.Acquire: Error while stat file")
+	}
+	p.Lock()
+	defer p.Unlock()
+	r, loaded := p.readers[filePath]
+	if !loaded {
+		r = NewReader(filePath, p.checkpoint)
+		p.readers[filePath] = r
+	} else if r.started {
+		if position.Whence != io.SeekEnd {
+			// read_from只在reader启动时生效, 不会为加入的订阅重新读取之前的内容
+			log.Printf("[WARN][reader.Pool.Acquire: read_from ignored, share running reader and read from current position][file:%s][sid:%s][read_from:%s]",
+				filePath, strategy.MetricName, strategy.ReadFrom)
+		} else {
+			log.Printf("[reader.Pool.Acquire: share running reader, read from current position][file:%s][sid:%s]", filePath, strategy.MetricName)
+		}
+	}
+	s := newSubscription(filePath, strategy, position, stream)
+	r.subscribe(s)
+	return s, nil
+}
+
+// Tailed 判断文件是否已经以其它路径读取, 返回该路径
+// 同一个inode正在或已经被其它路径的Reader读取(如符号链接、硬链接以及滚动后被重命名的文件),
+// 或在checkpoint中记录在其它路径下(agent停止期间滚动)时, 再次读取会从头重复统计
+func (p *Pool) Tailed(filePath string) (string, bool) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return "", false
+	}
+	dev, ino := fileInode(fi)
+	// 无法获取inode的平台上只能依赖路径识别文件
+	if ino == 0 {
+		return "", false
+	}
+	p.Lock()
+	defer p.Unlock()
+	for path, r := range p.readers {
+		if path == filePath {
+			continue
+		}
+		if r.started {
+			if r.reads(dev, ino) {
+				return path, true
+			}
+			continue
+		}
+		// 还没有开始读取的Reader以其路径当前的文件为准
+		if rfi, err := os.Stat(path); err == nil {
+			if d, i := fileInode(rfi); d == dev && i == ino {
+				return path, true
+			}
+		}
+	}
+	if e, loaded := p.checkpoint.Owner(dev, ino); loaded && e.Path != filePath {
+		return e.Path, true
+	}
+	return "", false
+}
+
+// Release 取消订阅, 文件的最后一个订阅取消时停止Reader
+func (p *Pool) Release(s *Subscription) {
+	p.Lock()
+	defer p.Unlock()
+	// 删除该订阅的读取指标, 解析相关的指标由消费者组停止时删除
+	defer s.deleteMetrics()
+	r, loaded := p.readers[s.FilePath]
+	// Reader启动失败时订阅已经被取消, 文件对应的可能已经是新的Reader
+	if !loaded || !r.subscribed(s) {
+		s.remove()
+		return
+	}
+	if r.unsubscribe(s) > 0 {
+		return
+	}
+	r.Stop()
+	delete(p.readers, s.FilePath)
+	log.Printf("[reader.Pool.Release: last subscription released, stop reading][file:%s]", s.FilePath)
+}
+
+// StartPending 启动还没有开始读取的Reader
+func (p *Pool) StartPending() {
+	p.Lock()
+	defer p.Unlock()
+	for filePath, r := range p.readers {
+		if r.started {
+			continue
+		}
+		if err := r.Start(); err != nil {
+			log.Printf("%+v", err)
+			// 启动失败时取消全部订阅, 下次扫描时重新订阅
+			for _, s := range r.subscriptions() {
+				r.unsubscribe(s)
+			}
+			delete(p.readers, filePath)
+		}
+	}
+}
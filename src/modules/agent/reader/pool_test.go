@@ -0,0 +1,63 @@
+package reader
+
+import (
+	"log2metrics/src/common"
+	"log2metrics/src/modules/agent/checkpoint"
+	"log2metrics/src/modules/agent/config"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// 同一个inode已经以其它路径读取或记录在checkpoint中时, Tailed返回该路径
+func TestPoolTailed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no inode on windows")
+	}
+	dir := t.TempDir()
+	app := filepath.Join(dir, "app.log")
+	link := filepath.Join(dir, "current.log")
+	moved := filepath.Join(dir, "app-old.log")
+	other := filepath.Join(dir, "other.log")
+	touch(t, app, other, moved)
+	if err := os.Link(app, link); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := checkpoint.NewStore(filepath.Join(dir, "checkpoint.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// moved为滚动前以old.log读取并记录了位置的文件
+	fi, err := os.Stat(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, ino := fileInode(fi)
+	old := filepath.Join(dir, "old.log")
+	store.Set(old, dev, ino, 5)
+
+	p := NewPool(store)
+	st := &config.LogStrategy{MetricName: "app_cnt", Overflow: &config.Overflow{Policy: common.OverflowDropNewest}}
+	sub, err := p.Acquire(app, st, &config.ReadPosition{}, make(chan string, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Release(sub)
+	cases := []struct {
+		path   string
+		want   string
+		tailed bool
+	}{
+		{app, "", false},
+		{link, app, true},
+		{moved, old, true},
+		{other, "", false},
+	}
+	for _, c := range cases {
+		if got, tailed := p.Tailed(c.path); got != c.want || tailed != c.tailed {
+			t.Errorf("Tailed(%q) = %q, %v, want %q, %v", c.path, got, tailed, c.want, c.tailed)
+		}
+	}
+}
@@ -1,8 +1,16 @@
 package reader
 
 import (
+	"bufio"
 	"io"
+	"io/ioutil"
 	"log"
+	"log2metrics/src/common"
+	"log2metrics/src/modules/agent/checkpoint"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hpcloud/tail"
@@ -10,34 +18,147 @@ import (
 )
 
 type Reader struct {
-	FilePath    string        // 日志路径
-	tailer      *tail.Tail    // tailer对象
-	Stream      chan string   //同步日志chan
-	CurrentPath string        // 当前路径
-	Close       chan struct{} // 	关闭的chan
-	FD          uint64        // 文件inode, 用来处理文件滚动时文件名发生变化的情况
+	FilePath    string     // 日志路径
+	tailer      *tail.Tail // tailer对象
+	CurrentPath string     // 当前路径
+	FD          uint64     // 文件inode, 用来处理文件滚动时文件名发生变化的情况
+
+	dev        uint64            // 文件所在设备, 与inode一起唯一标识文件
+	idMtx      sync.Mutex        // 保护读取goroutine之外对dev、FD以及rotated的访问
+	rotated    []inode           // 已经读取过的滚动前的文件, 最多保留common.RotatedInodes个
+	file       *os.File          // 持有当前inode的句柄, 用来判断文件是否发生了滚动或截断
+	size       int64             // 最近一次获取到的当前inode的文件大小
+	offset     int64             // 已经从当前inode中读取的位置
+	committed  int64             // 全部订阅都已经推送到Stream的位置, 记录到checkpoint中
+	checkpoint *checkpoint.Store // 读取位置存储, 为nil时不记录
+	started    bool
+	readDone   chan struct{} // StartRead退出后关闭
+
+	// 读取同一个文件的全部策略的订阅, 读取到的每一行都会推送给全部订阅
+	subMtx  sync.Mutex
+	subs    []*Subscription
+	matcher *matcher // 全部订阅的合并匹配器, 订阅变化时重新构建
+
+	// agent停止期间文件发生了滚动, 需要先把旧文件中未读取的部分读完
+	drainPath   string
+	drainOffset int64
+}
+
+// NewReader new reader函数, 订阅全部添加后调用Start开始读取
+func NewReader(filePath string, store *checkpoint.Store) *Reader {
+	return &Reader{
+		FilePath:    filePath,
+		CurrentPath: filePath,
+		checkpoint:  store,
+		readDone:    make(chan struct{}),
+	}
+}
+
+// 添加订阅
+func (r *Reader) subscribe(s *Subscription) {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	// 复制后替换, 读取goroutine持有的旧切片不受影响
+	subs := make([]*Subscription, 0, len(r.subs)+1)
+	r.subs = append(append(subs, r.subs...), s)
+	r.matcher = newMatcher(r.subs)
 }
 
-// NewReader new reader函数
-func NewReader(filePath string, stream chan string) (*Reader, error) {
-	r := &Reader{
-		FilePath: filePath,
-		Stream:   stream,
-		Close:    make(chan struct{}),
+// 删除订阅, 返回剩余的订阅数量
+func (r *Reader) unsubscribe(s *Subscription) int {
+	s.remove()
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	subs := make([]*Subscription, 0, len(r.subs))
+	for _, sub := range r.subs {
+		if sub != s {
+			subs = append(subs, sub)
+		}
 	}
-	// SeekEnd 从尾部开始打开文件
-	if err := r.openFile(io.SeekEnd, filePath); err != nil {
-		return nil, errors.Wrap(err, "")
+	r.subs = subs
+	r.matcher = newMatcher(subs)
+	return len(subs)
+}
+
+// 是否为该Reader的订阅
+func (r *Reader) subscribed(s *Subscription) bool {
+	for _, sub := range r.subscriptions() {
+		if sub == s {
+			return true
+		}
 	}
-	return r, nil
+	return false
+}
+
+func (r *Reader) subscriptions() []*Subscription {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	return r.subs
 }
 
-// 打开文件方法
-func (r *Reader) openFile(whence int, filePath string) error {
+// 当前的订阅及对应的合并匹配器
+func (r *Reader) dispatchTable() ([]*Subscription, *matcher) {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	return r.subs, r.matcher
+}
+
+// 打开文件方法, 起始位置为全部订阅中最早的位置, 各订阅在自己的起始位置之前的行会被跳过
+func (r *Reader) openFile(filePath string) error {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return errors.Wrap(err, "reader.openFile: Error while stat file")
+	}
+	dev, ino := fileInode(fi)
+
+	// 将起始位置换算为具体的offset, 便于之后记录读取位置
+	subs := r.subscriptions()
+	offset := fi.Size()
+	for _, s := range subs {
+		if o := s.startOffset(fi.Size()); o < offset {
+			offset = o
+		}
+	}
+	resumed := false
+	// 存在读取位置记录时优先从记录的位置恢复
+	if prev, loaded := r.checkpoint.Latest(filePath); loaded {
+		resumed = true
+		switch {
+		case prev.Dev == dev && prev.Ino == ino && prev.Offset <= fi.Size():
+			offset = prev.Offset
+			log.Printf("[reader.openFile: resume from checkpoint][file:%s][offset:%d]", filePath, offset)
+		case prev.Dev == dev && prev.Ino == ino:
+			// 文件在agent停止期间被截断
+			offset = 0
+			log.Printf("[reader.openFile: file truncated since last checkpoint, read from beginning][file:%s]", filePath)
+		default:
+			// inode发生变化, 说明文件在agent停止期间发生了滚动, 新文件的内容全部是新写入的
+			offset = 0
+			// 尝试在同目录下找到旧inode对应的文件, 把剩余内容读完
+			if rotated := findByInode(filepath.Dir(filePath), prev.Dev, prev.Ino); rotated != "" {
+				r.drainPath = rotated
+				r.drainOffset = prev.Offset
+			}
+			r.addRotated(prev.Dev, prev.Ino)
+			log.Printf("[reader.openFile: file rotated since last checkpoint, read from beginning][file:%s][rotated:%s]", filePath, r.drainPath)
+			r.checkpoint.Delete(prev.Path, prev.Dev, prev.Ino)
+		}
+	}
+	for _, s := range subs {
+		start := offset
+		if !resumed {
+			start = s.startOffset(fi.Size())
+		}
+		s.Lock()
+		s.init(start, resumed)
+		s.committed = offset
+		s.Unlock()
+	}
+
 	// 生成SeekInfo 决定文件从哪里开始读取
 	seekInfo := &tail.SeekInfo{
-		Offset: 0,
-		Whence: whence,
+		Offset: offset,
+		Whence: io.SeekStart,
 	}
 	config := tail.Config{
 		Location:  seekInfo, // 文件起始读位置
@@ -54,21 +175,40 @@ func (r *Reader) openFile(whence int, filePath string) error {
 	// 将tailer赋值给reader
 	r.tailer = t
 	r.CurrentPath = filePath
-	r.FD = 0
+	r.setInode(dev, ino)
+	r.offset = offset
+	r.committed = offset
+	r.size = fi.Size()
+	// 句柄打开失败时只影响读取位置的准确性, 不影响采集
+	if r.file, err = os.Open(filePath); err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "reader.openFile: open file for stat failed: %s", filePath))
+	}
 	return nil
 }
 
-func (r *Reader) Start() {
-	// 开始读取日志
-	r.StartRead()
+// Start 打开文件并开始读取日志
+func (r *Reader) Start() error {
+	if err := r.openFile(r.FilePath); err != nil {
+		return err
+	}
+	r.started = true
+	go r.StartRead()
+	return nil
 }
 
+// Stop 停止读取, 调用前全部订阅都已经取消
 func (r *Reader) Stop() {
+	if !r.started {
+		return
+	}
 	r.StopRead()
-	close(r.Close)
+	// 等待StartRead退出并记录最终的读取位置
+	<-r.readDone
 }
 
 func (r *Reader) StartRead() {
+	defer close(r.readDone)
+
 	// 统计read行数以及drop行数
 	var (
 		readCnt, readSwp int64
@@ -100,22 +240,273 @@ func (r *Reader) StartRead() {
 		}
 	}()
 
+	// 先读完agent停止期间被滚动走的旧文件
+	if r.drainPath != "" {
+		r.drainRotated()
+	}
+
+	lastSave := time.Now()
+	// 多行事件的推送超时
+	flushTimer := time.NewTimer(time.Hour)
+	stopTimer(flushTimer)
+	var flushC <-chan time.Time
 	// 利用tailer进行日志读取
-	for line := range r.tailer.Lines {
-		// 已读取行数自增统计
-		readCnt++
+loop:
+	for {
+		var dropped int64
 		select {
-		// 读取到的日志将会推送到stream中,供消费者组进行消费
-		case r.Stream <- line.Text:
-		default:
-			// 已过滤行数自增统计
-			dropCnt++
+		case line, ok := <-r.tailer.Lines:
+			if !ok {
+				break loop
+			}
+			// 已读取行数自增统计
+			readCnt++
+			n := int64(len(line.Text)) + 1
+			r.locate(n)
+			lineStart := r.offset
+			r.offset += n
+			dropped += r.dispatch(line.Text, lineStart, r.offset)
+		case <-flushC:
+			// 超时没有新行, 推送组装中的多行事件
+			now := time.Now()
+			for _, s := range r.subscriptions() {
+				if deadline, ok := s.flushDeadline(); ok && !deadline.After(now) && s.flush(r.offset) {
+					dropped++
+				}
+			}
+		}
+		// 已过滤行数自增统计
+		dropCnt += dropped
+		// 按照最早的推送超时重新计时
+		stopTimer(flushTimer)
+		flushC = nil
+		if deadline, ok := r.flushDeadline(); ok {
+			flushTimer.Reset(time.Until(deadline))
+			flushC = flushTimer.C
+		}
+		r.updateCommitted()
+		// 定期记录读取位置
+		if time.Since(lastSave) >= common.CheckpointInterval {
+			r.saveCheckpoint()
+			lastSave = time.Now()
 		}
 	}
+	stopTimer(flushTimer)
 	// 当读取日志loop退出,则把统计的go routine也退出
 	close(analysisClose)
+
+	// 退出前记录最终的读取位置
+	r.saveCheckpoint()
+	if r.file != nil {
+		r.file.Close()
+	}
+}
+
+// dispatch 一次扫描得到全部策略的字面量匹配结果, 再推送给读取该文件的全部策略, 返回被丢弃的行数
+func (r *Reader) dispatch(text string, lineStart, lineEnd int64) (dropped int64) {
+	subs, m := r.dispatchTable()
+	m.scan(text)
+	for i, s := range subs {
+		if s.handle(text, lineStart, lineEnd, m.result(i)) {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// 全部订阅中最早的多行事件推送超时时间
+func (r *Reader) flushDeadline() (time.Time, bool) {
+	var (
+		earliest time.Time
+		found    bool
+	)
+	for _, s := range r.subscriptions() {
+		if deadline, ok := s.flushDeadline(); ok && (!found || deadline.Before(earliest)) {
+			earliest, found = deadline, true
+		}
+	}
+	return earliest, found
+}
+
+// 更新全部订阅都已经推送的位置, 没有订阅时保持之前的位置
+func (r *Reader) updateCommitted() {
+	var (
+		committed int64
+		found     bool
+	)
+	for _, s := range r.subscriptions() {
+		if c, ok := s.committedOffset(); ok && (!found || c < committed) {
+			committed, found = c, true
+		}
+	}
+	if found {
+		r.committed = committed
+	}
+}
+
+// 停止timer并清空已经触发的事件, 保证Reset后不会收到之前的超时
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
 }
 
 func (r *Reader) StopRead() {
 	r.tailer.Stop()
 }
+
+// locate 判断长度为n的行是否来自滚动后的新文件
+// tailer只会在读完旧文件后才切换到滚动后的新文件(或截断后的文件), 所以当位置超出当前inode的大小时, 说明该行来自新文件
+func (r *Reader) locate(n int64) {
+	if r.file == nil || r.offset+n <= r.size {
+		return
+	}
+	// 超出已知大小时重新获取当前inode的大小
+	if fi, err := r.file.Stat(); err == nil {
+		r.size = fi.Size()
+	}
+	if r.offset+n > r.size {
+		// 组装中的多行事件属于旧文件, 切换前先推送
+		for _, s := range r.subscriptions() {
+			s.flush(r.offset)
+		}
+		r.switchFile()
+	}
+}
+
+// switchFile tailer已经切换到滚动后的新文件或截断后的文件, 从头开始记录读取位置
+func (r *Reader) switchFile() {
+	r.file.Close()
+	r.file = nil
+	r.offset = 0
+	r.committed = 0
+	r.size = 0
+	for _, s := range r.subscriptions() {
+		s.reset()
+	}
+
+	f, err := os.Open(r.CurrentPath)
+	if err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "reader.switchFile: open file failed: %s", r.CurrentPath))
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		log.Printf("%+v", errors.Wrapf(err, "reader.switchFile: stat file failed: %s", r.CurrentPath))
+		return
+	}
+	dev, ino := fileInode(fi)
+	if dev != r.dev || ino != r.FD {
+		log.Printf("[reader.switchFile: file rotated][file:%s][inode:%d->%d]", r.CurrentPath, r.FD, ino)
+		// 旧inode的读取位置已经不再需要
+		r.checkpoint.Delete(r.CurrentPath, r.dev, r.FD)
+	} else {
+		log.Printf("[reader.switchFile: file truncated][file:%s]", r.CurrentPath)
+	}
+	r.file = f
+	r.size = fi.Size()
+	r.setInode(dev, ino)
+}
+
+// inode device和inode唯一标识一个文件
+type inode struct {
+	dev, ino uint64
+}
+
+// 切换到新的文件, 之前的文件记为已经读取过的滚动前文件
+func (r *Reader) setInode(dev, ino uint64) {
+	if r.FD != 0 && (dev != r.dev || ino != r.FD) {
+		r.addRotated(r.dev, r.FD)
+	}
+	r.idMtx.Lock()
+	defer r.idMtx.Unlock()
+	r.dev = dev
+	r.FD = ino
+}
+
+func (r *Reader) addRotated(dev, ino uint64) {
+	r.idMtx.Lock()
+	defer r.idMtx.Unlock()
+	r.rotated = append(r.rotated, inode{dev: dev, ino: ino})
+	if n := len(r.rotated) - common.RotatedInodes; n > 0 {
+		r.rotated = append(r.rotated[:0], r.rotated[n:]...)
+	}
+}
+
+// reads 判断文件是否正在被该Reader读取, 或者是已经读取过的滚动前文件
+func (r *Reader) reads(dev, ino uint64) bool {
+	r.idMtx.Lock()
+	defer r.idMtx.Unlock()
+	if r.dev == dev && r.FD == ino {
+		return true
+	}
+	for _, id := range r.rotated {
+		if id.dev == dev && id.ino == ino {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reader) saveCheckpoint() {
+	r.checkpoint.Set(r.CurrentPath, r.dev, r.FD, r.committed)
+}
+
+// drainRotated 读取滚动前的旧文件从记录位置到结尾的完整行, 推送给全部订阅
+func (r *Reader) drainRotated() {
+	f, err := os.Open(r.drainPath)
+	if err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "reader.drainRotated: open rotated file failed: %s", r.drainPath))
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(r.drainOffset, io.SeekStart); err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "reader.drainRotated: seek rotated file failed: %s", r.drainPath))
+		return
+	}
+	var cnt int64
+	subs, m := r.dispatchTable()
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadString('\n')
+		// 只处理完整的行
+		if err != nil {
+			break
+		}
+		cnt++
+		text := strings.TrimRight(line, "\n")
+		m.scan(text)
+		for i, s := range subs {
+			s.drain(text, m.result(i))
+		}
+	}
+	for _, s := range subs {
+		s.drainFlush()
+	}
+	log.Printf("[reader.drainRotated: read rest of rotated file][file:%s][lines:%d]", r.drainPath, cnt)
+}
+
+// findByInode 在目录中查找device和inode相同的文件
+func findByInode(dir string, dev, ino uint64) string {
+	// 无法获取inode的平台上不做查找
+	if ino == 0 {
+		return ""
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if d, i := fileInode(fi); d == dev && i == ino {
+			return filepath.Join(dir, fi.Name())
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package reader
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"log"
+	"log2metrics/src/common"
+	"log2metrics/src/modules/agent/config"
+	"log2metrics/src/modules/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 推送结果
+const (
+	sendOK      = iota // 已推送(包括写入磁盘队列)
+	sendDropped        // 按照overflow策略被丢弃
+	sendClosed         // reader已经关闭
+)
+
+// sink 按照策略的overflow配置将日志推送到Stream
+type sink struct {
+	stream  chan string
+	policy  string
+	spill   *spillQueue
+	close   chan struct{}
+	dropped prometheus.Counter
+	depth   prometheus.Gauge
+}
+
+func newSink(filePath string, strategy *config.LogStrategy, stream chan string, close chan struct{}) *sink {
+	s := &sink{
+		stream:  stream,
+		policy:  strategy.Overflow.Policy,
+		close:   close,
+		dropped: metrics.LinesDropped.WithLabelValues(strategy.MetricName, filePath),
+		depth:   metrics.StreamDepth.WithLabelValues(strategy.MetricName, filePath),
+	}
+	if s.policy == common.OverflowSpill {
+		// 以metricName和文件路径区分磁盘队列文件, 重启后可以找回上次未读回的记录
+		sum := md5.Sum([]byte(strategy.MetricName + filePath))
+		q, err := newSpillQueue(strategy.Overflow.SpillDir, hex.EncodeToString(sum[:])+".spill", strategy.Overflow.SpillMaxBytes, stream)
+		if err != nil {
+			log.Printf("%+v", err)
+			// 磁盘队列不可用时退化为丢弃新行
+			s.policy = common.OverflowDropNewest
+		} else {
+			s.spill = q
+		}
+	}
+	return s
+}
+
+// send 推送一行日志
+func (s *sink) send(line string) int {
+	defer func() {
+		s.depth.Set(float64(len(s.stream)))
+	}()
+	switch s.policy {
+	case common.OverflowBlock:
+		select {
+		case s.stream <- line:
+			return sendOK
+		case <-s.close:
+			return sendClosed
+		}
+	case common.OverflowDropOldest:
+		res := sendOK
+		for {
+			select {
+			case s.stream <- line:
+				return res
+			default:
+			}
+			// Stream已满, 丢弃最早的一行后重试
+			select {
+			case <-s.stream:
+				s.dropped.Inc()
+				res = sendDropped
+			default:
+			}
+		}
+	case common.OverflowSpill:
+		// 磁盘队列中还有记录时直接写入磁盘, 保证顺序
+		if !s.spill.pending() {
+			select {
+			case s.stream <- line:
+				return sendOK
+			default:
+			}
+		}
+		if s.spill.push(line) {
+			return sendOK
+		}
+	default:
+		select {
+		case s.stream <- line:
+			return sendOK
+		default:
+		}
+	}
+	s.dropped.Inc()
+	return sendDropped
+}
+
+func (s *sink) stop() {
+	if s.spill != nil {
+		s.spill.stop()
+	}
+}
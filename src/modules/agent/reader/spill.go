@@ -0,0 +1,173 @@
+package reader
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// spillQueue 有界的磁盘队列, Stream满时将日志写入磁盘, Stream有空闲时再按顺序读回
+// 每条记录为4字节长度加内容, 支持包含换行的多行日志; 退出时未读回的记录保留在文件中, 下次启动继续读回
+type spillQueue struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+	readOff  int64 // 下一条待读回记录的位置
+	written  int64 // 文件中已写入的字节数
+	stream   chan string
+	notify   chan struct{} // 有新记录写入
+	close    chan struct{}
+	done     chan struct{} // 读回goroutine退出后关闭
+}
+
+func newSpillQueue(dir, name string, maxBytes int64, stream chan string) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "reader.newSpillQueue: create spill dir failed: %s", dir)
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reader.newSpillQueue: open spill file failed: %s", path)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "reader.newSpillQueue: stat spill file failed: %s", path)
+	}
+	q := &spillQueue{
+		path:     path,
+		maxBytes: maxBytes,
+		f:        f,
+		written:  fi.Size(),
+		stream:   stream,
+		notify:   make(chan struct{}, 1),
+		close:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if q.written > 0 {
+		log.Printf("[reader.newSpillQueue: replay spilled lines from last run][file:%s][bytes:%d]", path, q.written)
+	}
+	go q.drain()
+	return q, nil
+}
+
+// pending 是否还有未读回的记录, 存在时新的行也需要写入磁盘以保证顺序
+func (q *spillQueue) pending() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.written > q.readOff
+}
+
+// push 写入一条记录, 超过上限时返回false
+func (q *spillQueue) push(line string) bool {
+	q.Lock()
+	defer q.Unlock()
+	size := int64(len(line)) + 4
+	if q.written-q.readOff+size > q.maxBytes {
+		return false
+	}
+	buf := make([]byte, size)
+	binary.BigEndian.PutUint32(buf, uint32(len(line)))
+	copy(buf[4:], line)
+	if _, err := q.f.Write(buf); err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "spillQueue.push: write spill file failed: %s", q.path))
+		return false
+	}
+	q.written += size
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// drain 按顺序将记录读回Stream, 队列为空时清空文件
+func (q *spillQueue) drain() {
+	defer close(q.done)
+	for {
+		q.Lock()
+		if q.readOff >= q.written {
+			if q.written > 0 {
+				q.reset()
+			}
+			q.Unlock()
+			select {
+			case <-q.notify:
+				continue
+			case <-q.close:
+				return
+			}
+		}
+		line, n, err := q.readRecord(q.readOff)
+		if err != nil {
+			// 文件损坏时丢弃全部记录
+			log.Printf("%+v", errors.Wrapf(err, "spillQueue.drain: read spill file failed, discard it: %s", q.path))
+			q.reset()
+			q.Unlock()
+			continue
+		}
+		q.Unlock()
+
+		select {
+		case q.stream <- line:
+		case <-q.close:
+			return
+		}
+		q.Lock()
+		q.readOff += n
+		q.Unlock()
+	}
+}
+
+func (q *spillQueue) readRecord(off int64) (string, int64, error) {
+	head := make([]byte, 4)
+	if _, err := q.f.ReadAt(head, off); err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(head))
+	if off+4+size > q.written {
+		return "", 0, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, size)
+	if _, err := q.f.ReadAt(buf, off+4); err != nil {
+		return "", 0, err
+	}
+	return string(buf), size + 4, nil
+}
+
+// reset 清空文件, 调用方需持有锁
+func (q *spillQueue) reset() {
+	if err := q.f.Truncate(0); err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "spillQueue.reset: truncate spill file failed: %s", q.path))
+	}
+	q.readOff = 0
+	q.written = 0
+}
+
+// stop 停止读回, 将未读回的记录移动到文件头部, 供下次启动继续读回
+func (q *spillQueue) stop() {
+	close(q.close)
+	<-q.done
+
+	q.Lock()
+	defer q.Unlock()
+	defer q.f.Close()
+	if q.readOff == 0 {
+		return
+	}
+	rest := make([]byte, q.written-q.readOff)
+	if _, err := q.f.ReadAt(rest, q.readOff); err != nil && err != io.EOF {
+		log.Printf("%+v", errors.Wrapf(err, "spillQueue.stop: read spill file failed: %s", q.path))
+		return
+	}
+	q.reset()
+	if _, err := q.f.Write(rest); err != nil {
+		log.Printf("%+v", errors.Wrapf(err, "spillQueue.stop: write spill file failed: %s", q.path))
+	}
+}
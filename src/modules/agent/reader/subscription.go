@@ -0,0 +1,252 @@
+package reader
+
+import (
+	"io"
+	"log"
+	"log2metrics/src/modules/agent/config"
+	"log2metrics/src/modules/metrics"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Subscription 一个策略对共享Reader的订阅, 每个策略有独立的Stream/overflow策略/多行组装以及起始读取位置
+type Subscription struct {
+	sync.Mutex
+	FilePath  string
+	Strategy  *config.LogStrategy
+	sink      *sink         // 按照overflow策略推送到Stream
+	multiline *multiline    // 多行日志组装, 未配置时为nil
+	drainML   *multiline    // 读取滚动前旧文件时使用的多行组装
+	close     chan struct{} // 取消订阅时关闭, 让阻塞在Stream上的推送退出
+	closeOnce sync.Once
+	removed   bool
+	linesRead prometheus.Counter
+	// 合并匹配过滤掉的行, 与消费者使用相同的指标
+	unmatched prometheus.Counter
+	contains  prometheus.Counter
+	exclude   prometheus.Counter
+
+	position     *config.ReadPosition
+	ready        bool  // 是否已经确定起始读取位置
+	start        int64 // 起始读取位置, 之前的行跳过
+	sinceReached bool  // read_from为time时, 是否已经读到日志时间晚于Since的行
+	committed    int64 // 已经推送到Stream的日志在当前inode中的位置
+}
+
+func newSubscription(filePath string, strategy *config.LogStrategy, position *config.ReadPosition, stream chan string) *Subscription {
+	s := &Subscription{
+		FilePath:  filePath,
+		Strategy:  strategy,
+		close:     make(chan struct{}),
+		multiline: newMultiline(strategy.Multiline),
+		linesRead: metrics.LinesRead.WithLabelValues(strategy.MetricName, filePath),
+		unmatched: metrics.LinesUnmatched.WithLabelValues(strategy.MetricName, filePath),
+		contains:  metrics.LinesFiltered.WithLabelValues(strategy.MetricName, filePath, "contains"),
+		exclude:   metrics.LinesFiltered.WithLabelValues(strategy.MetricName, filePath, "exclude"),
+		position:  position,
+	}
+	s.sink = newSink(filePath, strategy, stream, s.close)
+	return s
+}
+
+// 根据read_from换算起始读取位置, size为文件当前大小
+func (s *Subscription) startOffset(size int64) int64 {
+	offset := s.position.Offset
+	if s.position.Whence == io.SeekEnd || offset > size {
+		offset = size
+	}
+	return offset
+}
+
+// 确定起始读取位置, resumed为true时表示从checkpoint记录的位置恢复, 不再跳过任何行
+func (s *Subscription) init(start int64, resumed bool) {
+	s.ready = true
+	s.start = start
+	s.committed = start
+	// 没有时间过滤时无需判断日志时间
+	s.sinceReached = resumed || s.position.Since.IsZero()
+}
+
+// handle 处理[lineStart, lineEnd)位置的一行日志, res为合并匹配的结果, 返回是否被丢弃
+func (s *Subscription) handle(text string, lineStart, lineEnd int64, res int) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.removed {
+		return false
+	}
+	// Reader运行中加入的订阅从当前行开始读取
+	if !s.ready {
+		s.init(lineStart, false)
+	}
+	s.linesRead.Inc()
+	if lineStart < s.start {
+		s.committed = lineEnd
+		return false
+	}
+	if s.multiline == nil {
+		return s.emit(text, lineEnd, res)
+	}
+	// 配置了multiline时先组装为完整的事件, 新事件开始时推送之前的事件, 读取位置记录到当前行之前
+	if event, ok := s.multiline.add(text); ok {
+		return s.emit(event, lineStart, matchPass)
+	}
+	return false
+}
+
+// flush 推送组装中的多行事件, end为事件结束的位置
+func (s *Subscription) flush(end int64) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.removed || s.multiline == nil {
+		return false
+	}
+	if event, ok := s.multiline.flush(); ok {
+		return s.emit(event, end, matchPass)
+	}
+	return false
+}
+
+// emit 将日志事件按照overflow策略推送到Stream, end为事件结束的位置, 返回是否被丢弃
+func (s *Subscription) emit(text string, end int64, res int) bool {
+	// read_from为time时跳过早于指定时间的行
+	if !s.reachSince(text) {
+		s.committed = end
+		return false
+	}
+	// 合并匹配判断不可能匹配的行不再推送
+	if s.skip(text, res) {
+		s.committed = end
+		return false
+	}
+	// 读取到的日志将会按照overflow策略推送到stream中,供消费者组进行消费
+	switch s.sink.send(text) {
+	case sendClosed:
+		// 订阅正在取消, 未推送的行不计入读取位置, 下次启动时重新读取
+		return false
+	case sendDropped:
+		s.committed = end
+		return true
+	}
+	s.committed = end
+	return false
+}
+
+// skip 对合并匹配过滤掉的行计数, 统计口径与消费者相同: 先contains, 再exclude, 最后主正则
+func (s *Subscription) skip(text string, res int) bool {
+	switch res {
+	case missContains:
+		s.contains.Inc()
+	case missLiteral:
+		for _, reg := range s.Strategy.ExcludeRegs {
+			if reg.MatchString(text) {
+				s.exclude.Inc()
+				return true
+			}
+		}
+		s.unmatched.Inc()
+	default:
+		return false
+	}
+	return true
+}
+
+// reachSince 判断是否已经读到日志时间不早于Since的行, 日志按时间顺序写入, 之后的行不再判断
+func (s *Subscription) reachSince(text string) bool {
+	if s.sinceReached {
+		return true
+	}
+	t, ok := s.position.ParseTime(text)
+	if !ok || t.Before(s.position.Since) {
+		return false
+	}
+	log.Printf("[reader.reachSince: start from log time][file:%s][sid:%s][time:%s]", s.FilePath, s.Strategy.MetricName, t)
+	s.sinceReached = true
+	return true
+}
+
+// reset 文件发生滚动或截断, 新文件从头开始读取
+func (s *Subscription) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.start = 0
+	s.committed = 0
+}
+
+// 取消订阅, 之后Reader不会再向该订阅推送日志, 可以重复调用
+func (s *Subscription) remove() {
+	// 先关闭close, 让阻塞在Stream上的推送退出并释放锁
+	s.closeOnce.Do(func() { close(s.close) })
+	s.Lock()
+	removed := s.removed
+	s.removed = true
+	s.Unlock()
+	if !removed {
+		s.sink.stop()
+	}
+}
+
+// 删除只由订阅更新的指标
+func (s *Subscription) deleteMetrics() {
+	metrics.LinesRead.DeleteLabelValues(s.Strategy.MetricName, s.FilePath)
+	metrics.LinesDropped.DeleteLabelValues(s.Strategy.MetricName, s.FilePath)
+}
+
+// Removed 订阅是否已经被取消, Reader启动失败时会取消其全部订阅
+func (s *Subscription) Removed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.removed
+}
+
+// 组装中的多行事件的推送超时时间, 没有组装中的事件时返回false
+func (s *Subscription) flushDeadline() (time.Time, bool) {
+	s.Lock()
+	defer s.Unlock()
+	if s.removed || s.multiline == nil || !s.multiline.pending() {
+		return time.Time{}, false
+	}
+	return s.multiline.deadline(), true
+}
+
+// 已经推送到Stream的位置, 还没有确定起始读取位置时返回false
+func (s *Subscription) committedOffset() (int64, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.committed, s.ready && !s.removed
+}
+
+// drain 推送滚动前旧文件中剩余的行, 旧文件不记录读取位置, 使用单独的多行组装
+func (s *Subscription) drain(text string, res int) {
+	s.Lock()
+	defer s.Unlock()
+	if s.removed {
+		return
+	}
+	if s.multiline != nil {
+		if s.drainML == nil {
+			s.drainML = newMultiline(s.multiline.conf)
+		}
+		var ok bool
+		if text, ok = s.drainML.add(text); !ok {
+			return
+		}
+	} else if s.skip(text, res) {
+		return
+	}
+	s.sink.send(text)
+}
+
+// drainFlush 推送旧文件中最后一个组装中的多行事件
+func (s *Subscription) drainFlush() {
+	s.Lock()
+	defer s.Unlock()
+	if s.removed || s.drainML == nil {
+		return
+	}
+	if text, ok := s.drainML.flush(); ok {
+		s.sink.send(text)
+	}
+	s.drainML = nil
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SeriesSource 提供metric全部series的当前值, 由PointCounterManager实现, 在抓取时调用
+type SeriesSource interface {
+	RangeSeries(metric *StrategyMetric, fn func(labelMap map[string]string, value float64))
+}
+
+// seriesCollector cnt/sum/max/min/avg对应的指标, 本身不保存数值, 抓取时直接从SeriesSource计算
+type seriesCollector struct {
+	metric     *StrategyMetric
+	source     SeriesSource
+	desc       *prometheus.Desc
+	valueType  prometheus.ValueType
+	labelNames []string
+}
+
+func newSeriesCollector(m *StrategyMetric, source SeriesSource, valueType prometheus.ValueType) *seriesCollector {
+	labelNames := m.Strategy.LabelNames()
+	return &seriesCollector{
+		metric:     m,
+		source:     source,
+		desc:       prometheus.NewDesc(m.Strategy.MetricName, m.Strategy.MetricHelp, labelNames, nil),
+		valueType:  valueType,
+		labelNames: labelNames,
+	}
+}
+
+func (c *seriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *seriesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.source.RangeSeries(c.metric, func(labelMap map[string]string, value float64) {
+		// 按照指标的标签名顺序取标签值, 缺少的标签为空字符串
+		values := make([]string, len(c.labelNames))
+		for i, name := range c.labelNames {
+			values[i] = labelMap[name]
+		}
+		m, err := prometheus.NewConstMetric(c.desc, c.valueType, value, values...)
+		if err != nil {
+			log.Printf("[seriesCollector.Collect: new metric failed][name:%v][err:%v]", c.metric.Strategy.MetricName, err)
+			return
+		}
+		ch <- m
+	})
+}
@@ -1,29 +1,180 @@
 package metrics
 
 import (
+	"log"
+	"log2metrics/src/common"
 	"log2metrics/src/modules/agent/config"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func CreateMetrics(ss []*config.LogStrategy) map[string]*prometheus.GaugeVec {
-	mmap := map[string]*prometheus.GaugeVec{}
+// StrategyMetric 策略对应的prometheus指标
+type StrategyMetric struct {
+	Strategy *config.LogStrategy
+	// 根据策略的func选择指标类型:
+	// cnt/sum/max/min/avg 在抓取时从PointCounter计算, cnt/sum为counter类型, 其余为gauge类型
+	// histogram/summary 为 *prometheus.HistogramVec/*prometheus.SummaryVec, 在更新时直接observe
+	Collector prometheus.Collector
+	// 共用该指标的全部策略的指纹, 策略被修改后旧策略遗留的数据不再写入该指标
+	fingerprints map[string]bool
+}
+
+// Owns 判断指纹对应的策略是否属于该指标
+func (m *StrategyMetric) Owns(fingerprint string) bool {
+	return m.fingerprints[fingerprint]
+}
+
+// MetricsRegistry 维护策略对应的指标, 配置热加载时进行增量注册/注销
+type MetricsRegistry struct {
+	sync.Mutex
+	registerer prometheus.Registerer
+	// 抓取时提供cnt/sum/max/min/avg的值
+	source SeriesSource
+	// key为metricName
+	entries map[string]*metricEntry
+}
+
+type metricEntry struct {
+	fingerprint string // 该metric下全部策略的指纹, 变化时重建指标
+	metric      *StrategyMetric
+}
+
+func NewMetricsRegistry(registerer prometheus.Registerer, source SeriesSource) *MetricsRegistry {
+	return &MetricsRegistry{
+		registerer: registerer,
+		source:     source,
+		entries:    make(map[string]*metricEntry),
+	}
+}
+
+// Sync 根据最新的策略列表同步注册的指标
+// 策略内容未变化的metric沿用原指标以保留已有数值, 策略被修改的metric会重建指标,
+// PointCounterManager.SetMetricsMap 会据此重置该metric下的PointCounter
+func (mr *MetricsRegistry) Sync(ss []*config.LogStrategy) map[string]*StrategyMetric {
+	mr.Lock()
+	defer mr.Unlock()
+
+	// 按metricName对策略分组, 多个策略(如不同文件)可以共用同一个metric
+	var names []string
+	groups := map[string][]*config.LogStrategy{}
 	for _, s := range ss {
-		var labels []string
-		for k := range s.Tags {
-			labels = append(labels, k)
-		}
-		m := prometheus.NewGaugeVec(prometheus.GaugeOpts{
-			Name: s.MetricName,
-			Help: s.MetricHelp,
-		}, labels)
-		mmap[s.MetricName] = m
+		if _, loaded := groups[s.MetricName]; !loaded {
+			names = append(names, s.MetricName)
+		}
+		groups[s.MetricName] = append(groups[s.MetricName], s)
+	}
+
+	mmap := map[string]*StrategyMetric{}
+	for _, name := range names {
+		// 与第一个策略的标签、help或func不一致的策略被拒绝, 不属于该指标, 也不会为其启动消费者
+		group := groups[name][:1]
+		sign := metricSign(group[0])
+		for _, s := range groups[name][1:] {
+			if metricSign(s) != sign {
+				log.Printf("[MetricsRegistry.Sync: metric conflict, labels, help or func mismatch, strategy rejected][name:%s][file:%s]", name, s.FilePath)
+				continue
+			}
+			group = append(group, s)
+		}
+		fps := make([]string, 0, len(group))
+		for _, s := range group {
+			fps = append(fps, s.Fingerprint())
+		}
+		fingerprint := groupFingerprint(fps)
+		// 指纹未变化, 沿用原指标
+		if e, loaded := mr.entries[name]; loaded {
+			if e.fingerprint == fingerprint {
+				mmap[name] = e.metric
+				continue
+			}
+			// 策略被修改, 注销后重建
+			log.Printf("[MetricsRegistry.Sync: strategy modified, rebuild metric][name:%s]", name)
+			mr.registerer.Unregister(e.metric.Collector)
+			delete(mr.entries, name)
+		}
+		m := NewStrategyMetric(group[0], mr.source)
+		m.fingerprints = make(map[string]bool, len(fps))
+		for _, fp := range fps {
+			m.fingerprints[fp] = true
+		}
+		if err := mr.registerer.Register(m.Collector); err != nil {
+			log.Printf("%+v", errors.Wrapf(err, "MetricsRegistry.Sync: register metric failed: %s", name))
+			continue
+		}
+		mr.entries[name] = &metricEntry{fingerprint: fingerprint, metric: m}
+		mmap[name] = m
+	}
+
+	// 注销本次配置中已经不存在的metric
+	for name, e := range mr.entries {
+		if _, loaded := mmap[name]; !loaded {
+			log.Printf("[MetricsRegistry.Sync: unregister metric][name:%s]", name)
+			mr.registerer.Unregister(e.metric.Collector)
+			delete(mr.entries, name)
+		}
 	}
 	return mmap
 }
+
+// NewStrategyMetric 根据策略的func构造对应类型的指标
+func NewStrategyMetric(s *config.LogStrategy, source SeriesSource) *StrategyMetric {
+	m := &StrategyMetric{Strategy: s}
+	switch s.Func {
+	case common.LogFuncCnt, common.LogFuncSum:
+		m.Collector = newSeriesCollector(m, source, prometheus.CounterValue)
+	case common.LogFuncHistogram:
+		buckets := s.Histogram.Buckets
+		if e := s.Histogram.Exponential; e != nil {
+			buckets = prometheus.ExponentialBuckets(e.Start, e.Factor, e.Count)
+		}
+		opts := prometheus.HistogramOpts{
+			Name:    s.MetricName,
+			Help:    s.MetricHelp,
+			Buckets: buckets,
+		}
+		if n := s.Histogram.Native; n != nil {
+			opts.NativeHistogramBucketFactor = n.BucketFactor
+			opts.NativeHistogramMaxBucketNumber = n.MaxBuckets
+			opts.NativeHistogramMinResetDuration = n.MinResetDuration
+		}
+		m.Collector = prometheus.NewHistogramVec(opts, s.LabelNames())
+	case common.LogFuncSummary:
+		objectives := make(map[float64]float64, len(s.Summary.Quantiles))
+		for _, q := range s.Summary.Quantiles {
+			// 误差取分位数尾部的1/10, 如0.99对应0.001
+			objectives[q] = (1 - q) / 10
+		}
+		m.Collector = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:       s.MetricName,
+			Help:       s.MetricHelp,
+			Objectives: objectives,
+			MaxAge:     s.Summary.MaxAge,
+		}, s.LabelNames())
+	default:
+		m.Collector = newSeriesCollector(m, source, prometheus.GaugeValue)
+	}
+	return m
+}
+
+// metricSign 由metricName、help、func以及排序后的标签名构成
+func metricSign(s *config.LogStrategy) string {
+	return s.MetricName + "|" + s.MetricHelp + "|" + s.Func + "|" + strings.Join(s.LabelNames(), ",")
+}
+
+// groupFingerprint 共用同一个metric的全部策略的指纹
+func groupFingerprint(fps []string) string {
+	fps = append([]string(nil), fps...)
+	sort.Strings(fps)
+	return strings.Join(fps, ",")
+}
+
 func StartMetricWeb(addr string) error {
 	http.Handle("/metrics", promhttp.Handler())
 	srv := http.Server{Addr: addr}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"log2metrics/src/common"
+	"log2metrics/src/modules/agent/config"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 按策略的标签名返回一个series
+type fakeSource struct{}
+
+func (fakeSource) RangeSeries(m *StrategyMetric, fn func(labelMap map[string]string, value float64)) {
+	labelMap := make(map[string]string)
+	for _, name := range m.Strategy.LabelNames() {
+		labelMap[name] = "v"
+	}
+	fn(labelMap, 1)
+}
+
+// 同名metric的标签不一致时拒绝后面的策略, 其数据不会写入该指标
+func TestSyncRejectsConflictingStrategy(t *testing.T) {
+	code := &config.LogStrategy{MetricName: "ngx_req", FilePath: "a.log", Func: common.LogFuncCnt, Tags: map[string]string{"code": `code=(\d+)`}}
+	path := &config.LogStrategy{MetricName: "ngx_req", FilePath: "b.log", Func: common.LogFuncCnt, Tags: map[string]string{"path": `GET (\S+)`}}
+	same := &config.LogStrategy{MetricName: "ngx_req", FilePath: "c.log", Func: common.LogFuncCnt, Tags: map[string]string{"code": `code=(\d+)`}}
+
+	reg := prometheus.NewRegistry()
+	mmap := NewMetricsRegistry(reg, fakeSource{}).Sync([]*config.LogStrategy{code, path, same})
+	m := mmap["ngx_req"]
+	if m == nil {
+		t.Fatalf("metric ngx_req not registered")
+	}
+	if !m.Owns(code.Fingerprint()) || !m.Owns(same.Fingerprint()) {
+		t.Errorf("metric does not own the strategies with matching labels")
+	}
+	if m.Owns(path.Fingerprint()) {
+		t.Errorf("metric owns the conflicting strategy")
+	}
+	if _, err := reg.Gather(); err != nil {
+		t.Errorf("gather failed: %v", err)
+	}
+}
+
+// 拒绝的策略修改为一致后, 重建指标并接收其数据
+func TestSyncAcceptsResolvedConflict(t *testing.T) {
+	code := &config.LogStrategy{MetricName: "ngx_req", FilePath: "a.log", Func: common.LogFuncCnt, Tags: map[string]string{"code": `code=(\d+)`}}
+	path := &config.LogStrategy{MetricName: "ngx_req", FilePath: "b.log", Func: common.LogFuncSum, Tags: map[string]string{"code": `code=(\d+)`}}
+
+	mr := NewMetricsRegistry(prometheus.NewRegistry(), fakeSource{})
+	if m := mr.Sync([]*config.LogStrategy{code, path})["ngx_req"]; m.Owns(path.Fingerprint()) {
+		t.Fatalf("metric owns the strategy with a different func")
+	}
+	path.Func = common.LogFuncCnt
+	if m := mr.Sync([]*config.LogStrategy{code, path})["ngx_req"]; !m.Owns(path.Fingerprint()) {
+		t.Errorf("metric does not own the strategy after the conflict is resolved")
+	}
+}
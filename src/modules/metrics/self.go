@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// agent自身的运行指标, 与策略的metrics注册在同一个Registerer中
+var (
+	// LinesRead reader读取到的日志行数
+	LinesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_lines_read_total",
+		Help: "Number of log lines read from files.",
+	}, []string{"metric_name", "file_path"})
+	// LinesDropped Stream满时按照overflow策略被丢弃的日志行数
+	LinesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_lines_dropped_total",
+		Help: "Number of log lines dropped because the strategy stream was full.",
+	}, []string{"metric_name", "file_path"})
+	// LinesMatched 匹配主正则的日志行数
+	LinesMatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_lines_matched_total",
+		Help: "Number of log lines matched by the strategy pattern.",
+	}, []string{"metric_name", "file_path"})
+	// LinesUnmatched 未匹配主正则的日志行数
+	LinesUnmatched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_lines_unmatched_total",
+		Help: "Number of log lines not matched by the strategy pattern.",
+	}, []string{"metric_name", "file_path"})
+	// LinesFiltered 在解析之前被contains/exclude过滤掉的日志行数
+	LinesFiltered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_lines_filtered_total",
+		Help: "Number of log lines filtered out before parsing, by stage.",
+	}, []string{"metric_name", "file_path", "stage"})
+	// TagMisses 匹配主正则但tag正则未匹配到的次数
+	TagMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_tag_misses_total",
+		Help: "Number of matched log lines where the tag regexp did not match.",
+	}, []string{"metric_name", "tag"})
+	// AnalysisDuration 单行日志的分析耗时
+	AnalysisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "log2metrics_analysis_duration_seconds",
+		Help:    "Time spent analysing a single log line.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+	}, []string{"metric_name"})
+	// AnalysisPanics 分析过程中recover的panic次数
+	AnalysisPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_analysis_panics_total",
+		Help: "Number of panics recovered while analysing log lines.",
+	}, []string{"metric_name", "file_path"})
+	// StreamDepth reader与consumer之间Stream中积压的行数
+	StreamDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "log2metrics_stream_depth",
+		Help: "Number of log lines waiting in the strategy stream.",
+	}, []string{"metric_name", "file_path"})
+	// Consumers 每个文件的消费者数量, 配置autoscale时随Stream积压变化
+	Consumers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "log2metrics_consumers",
+		Help: "Number of consumers analysing the strategy stream.",
+	}, []string{"metric_name", "file_path"})
+	// ActiveJobs 正在运行的logJob数量
+	ActiveJobs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "log2metrics_active_jobs",
+		Help: "Number of running log jobs.",
+	})
+	// ActiveSeries PointCounterManager中的series数量
+	ActiveSeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "log2metrics_active_series",
+		Help: "Number of series held by the point counter manager.",
+	}, []string{"metric_name"})
+	// SeriesRejected 超过max_series后被合并或丢弃的新标签组合次数
+	SeriesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log2metrics_series_rejected_total",
+		Help: "Number of analysis points with new label combinations rejected by the series limit.",
+	}, []string{"metric_name", "action"})
+)
+
+// RegisterSelfMetrics 注册agent自身的运行指标, counterQueue的积压在抓取时计算
+func RegisterSelfMetrics(registerer prometheus.Registerer, counterQueueDepth func() float64) error {
+	for _, c := range []prometheus.Collector{
+		LinesRead,
+		LinesDropped,
+		LinesMatched,
+		LinesUnmatched,
+		LinesFiltered,
+		TagMisses,
+		AnalysisDuration,
+		AnalysisPanics,
+		StreamDepth,
+		Consumers,
+		ActiveJobs,
+		ActiveSeries,
+		SeriesRejected,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "log2metrics_counter_queue_depth",
+			Help: "Number of analysis point batches waiting in the counter queue.",
+		}, counterQueueDepth),
+	} {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}